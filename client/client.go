@@ -1,23 +1,48 @@
 package client
 
 import (
+	"encoding/json"
 	"errors"
+	log "github.com/sirupsen/logrus"
 	"gogrok.ccatss.dev/common"
 	"golang.org/x/crypto/ssh"
 	"net"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	ErrUnsupportedBackend = errors.New("unsupported backend type")
+	ErrPoolUnsupported    = errors.New("server does not support pool mode")
 )
 
+// VerificationRequiredError is returned when registering a custom domain which hasn't been verified.
+// The host can be registered once a TXT record named Record containing Token has been published.
+type VerificationRequiredError struct {
+	Host   string
+	Record string
+	Token  string
+}
+
+func (e *VerificationRequiredError) Error() string {
+	return "host " + e.Host + " requires verification using a TXT record " + e.Record + " with value " + e.Token
+}
+
 // New creates a new client with the specified server and backend
-func New(server string, signer ssh.Signer) *Client {
-	return &Client{
+func New(server string, signer ssh.Signer, opts ...Option) *Client {
+	c := &Client{
 		server: server,
 		signer: signer,
 	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
 }
 
 // Client is a remote tunnel client
@@ -26,6 +51,50 @@ type Client struct {
 
 	server string
 	signer ssh.Signer
+
+	pool       string
+	poolCookie string
+
+	healthPath     string
+	healthInterval time.Duration
+
+	compression []string
+
+	// extensions is set when the server supports protocol extensions
+	extensions bool
+
+	// forwarding is set while a host is forwarded, as each connection handles a single forward
+	forwarding int32
+
+	// channels receives forwarded channels, as a channel type's handler can only be registered once per connection
+	channels     <-chan ssh.NewChannel
+	channelsOnce sync.Once
+}
+
+// Option represents a func used to assign options to a Client
+type Option func(c *Client)
+
+// WithPool shares the requested host with other clients in pool mode, with requests distributed using strategy
+// (common.PoolRoundRobin, common.PoolLeastInFlight, common.PoolHashIP or common.PoolHashCookie)
+func WithPool(strategy string) Option {
+	return func(c *Client) {
+		c.pool = strategy
+	}
+}
+
+// WithCompression offers compression algorithms (common.CompressionZstd or common.CompressionGzip) in order of preference,
+// compressing forwarded requests and responses if the server accepts one of them.
+func WithCompression(algorithms ...string) Option {
+	return func(c *Client) {
+		c.compression = algorithms
+	}
+}
+
+// WithPoolCookie sets the cookie used for sticky sessions by common.PoolHashCookie pools
+func WithPoolCookie(name string) Option {
+	return func(c *Client) {
+		c.poolCookie = name
+	}
 }
 
 // Open opens a connection to the server
@@ -52,9 +121,37 @@ func (c *Client) Open() error {
 
 	c.conn = conn
 
+	// Servers without extension support reject the request, and can't parse optional fields
+	c.extensions, _, _ = conn.SendRequest(common.ProtocolExtensions, true, nil)
+
 	return nil
 }
 
+// Ping measures the round trip time to the server using an ssh keepalive request
+func (c *Client) Ping() (time.Duration, error) {
+	if err := c.Open(); err != nil {
+		return 0, err
+	}
+
+	start := time.Now()
+
+	// The server's reply is ignored, any reply completes the round trip
+	if _, _, err := c.conn.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+		return 0, err
+	}
+
+	return time.Since(start), nil
+}
+
+// Wait blocks until the connection to the server is closed
+func (c *Client) Wait() error {
+	if c.conn == nil {
+		return nil
+	}
+
+	return c.conn.Wait()
+}
+
 func (c *Client) Close() error {
 	if c.conn == nil {
 		return nil
@@ -63,8 +160,11 @@ func (c *Client) Close() error {
 	return c.conn.Close()
 }
 
-// Start connects to the server over TCP and starts the tunnel
-func (c *Client) Start(backend, requestedHost string) (string, error) {
+// Start connects to the server over TCP and starts the tunnel.
+// Supported backends are http(s) urls, http+unix:// and https+unix:// urls for http servers on unix sockets,
+// unix:// or tcp:// urls which are passed the raw stream without header rewriting,
+// and file:// urls serving a local directory.
+func (c *Client) Start(backend, requestedHost string, opts ...ProxyOption) (string, error) {
 	if err := c.Open(); err != nil {
 		return "", err
 	}
@@ -72,23 +172,33 @@ func (c *Client) Start(backend, requestedHost string) (string, error) {
 	backendUrl, err := url.Parse(backend)
 
 	if err != nil {
-		return "", nil
+		return "", err
 	}
 
 	if backendUrl.Scheme == "" {
 		backendUrl.Scheme = "http"
 	}
 
-	if backendUrl.Scheme == "http" || backendUrl.Scheme == "https" {
-		proxy := NewHTTPProxy(backendUrl)
-
-		return c.StartHTTPForwarding(proxy, requestedHost)
+	var proxy Proxy
+
+	switch backendUrl.Scheme {
+	case "http", "https", "http+unix", "https+unix":
+		proxy = NewHTTPProxy(backendUrl, opts...)
+	case "unix":
+		proxy = NewStreamProxy("unix", localPath(backendUrl), opts...)
+	case "tcp":
+		proxy = NewStreamProxy("tcp", backendUrl.Host, opts...)
+	case "file":
+		proxy = NewFileProxy(localPath(backendUrl), opts...)
+	default:
+		return "", ErrUnsupportedBackend
 	}
 
-	return "", ErrUnsupportedBackend
+	return c.StartHTTPForwarding(proxy, requestedHost)
 }
 
 // Register a host as reserved with the server
+// Custom domains return a *VerificationRequiredError until verified, after which Register should be called again.
 func (c *Client) Register(host string) error {
 	if err := c.Open(); err != nil {
 		return err
@@ -114,6 +224,22 @@ func (c *Client) Register(host string) error {
 		return err
 	}
 
+	var ext common.RegisterSuccessExtensions
+
+	if err = common.UnmarshalExtensions(res.Extensions, &ext); err != nil {
+		return err
+	}
+
+	if ext.Token != "" {
+		return &VerificationRequiredError{
+			Host:   res.Host,
+			Record: ext.Record,
+			Token:  ext.Token,
+		}
+	}
+
+	logNotice(ext.Notice)
+
 	return nil
 }
 
@@ -146,36 +272,203 @@ func (c *Client) Unregister(host string) error {
 	return nil
 }
 
+// Transfer a registered host to another public key
+func (c *Client) Transfer(host, key string) error {
+	return c.sendOwnerRequest(common.HttpTransferHost, host, key)
+}
+
+// AddOwner adds a public key as a co-owner of a registered host
+func (c *Client) AddOwner(host, key string) error {
+	return c.sendOwnerRequest(common.HttpAddOwner, host, key)
+}
+
+// RemoveOwner removes a public key from the co-owners of a registered host
+func (c *Client) RemoveOwner(host, key string) error {
+	return c.sendOwnerRequest(common.HttpRemoveOwner, host, key)
+}
+
+// sendOwnerRequest sends an ownership request for host and key
+func (c *Client) sendOwnerRequest(requestType, host, key string) error {
+	if err := c.Open(); err != nil {
+		return err
+	}
+
+	payload := ssh.Marshal(common.HostOwnerRequest{
+		Host: host,
+		Key:  key,
+	})
+
+	success, replyData, err := c.conn.SendRequest(requestType, true, payload)
+
+	if err != nil {
+		return err
+	}
+
+	if !success {
+		return errors.New(string(replyData))
+	}
+
+	var res common.HostRegisterSuccess
+
+	return ssh.Unmarshal(replyData, &res)
+}
+
+// Usage retrieves the bandwidth usage and quotas of the client key
+func (c *Client) Usage() (*common.UsageResponse, error) {
+	if err := c.Open(); err != nil {
+		return nil, err
+	}
+
+	success, replyData, err := c.conn.SendRequest(common.HttpUsage, true, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !success {
+		return nil, errors.New(string(replyData))
+	}
+
+	var res common.UsageResponse
+
+	if err = ssh.Unmarshal(replyData, &res); err != nil {
+		return nil, err
+	}
+
+	return &res, nil
+}
+
+// ListHosts retrieves the hosts owned or co-owned by the client key
+func (c *Client) ListHosts() ([]common.HostInfo, error) {
+	if err := c.Open(); err != nil {
+		return nil, err
+	}
+
+	success, replyData, err := c.conn.SendRequest(common.HttpListHosts, true, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !success {
+		return nil, errors.New(string(replyData))
+	}
+
+	var hosts []common.HostInfo
+
+	if err = json.Unmarshal(replyData, &hosts); err != nil {
+		return nil, err
+	}
+
+	return hosts, nil
+}
+
 // StartHTTPForwarding starts a basic http proxy/forwarding service
-func (c *Client) StartHTTPForwarding(proxy *HTTPProxy, requestedHost string) (string, error) {
-	payload := ssh.Marshal(common.RemoteForwardRequest{
-		RequestedHost: requestedHost,
+func (c *Client) StartHTTPForwarding(proxy Proxy, requestedHost string) (string, error) {
+	if !atomic.CompareAndSwapInt32(&c.forwarding, 0, 1) {
+		return "", ErrAlreadyForwarding
+	}
+
+	ch := c.forwardedChannels()
+
+	if ch == nil {
+		atomic.StoreInt32(&c.forwarding, 0)
+		return "", ErrAlreadyForwarding
+	}
+
+	host, compression, err := c.requestForward(requestedHost, c.compression)
+
+	if err != nil {
+		atomic.StoreInt32(&c.forwarding, 0)
+		return "", err
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		acceptConnections(proxy, ch, compression)
+
+		close(done)
+
+		c.cancelForward(host)
+	}()
+
+	if checker, ok := proxy.(HealthChecker); ok && c.healthPath != "" {
+		go c.monitorHealth(checker, host, done)
+	}
+
+	return host, nil
+}
+
+// forwardedChannels registers the forwarded channel handler on first use, returning the same channel afterwards.
+// It's registered before requesting a forward, so channels opened as soon as the forward succeeds aren't rejected.
+func (c *Client) forwardedChannels() <-chan ssh.NewChannel {
+	c.channelsOnce.Do(func() {
+		c.channels = c.conn.HandleChannelOpen(common.ForwardedHTTPChannelType)
 	})
 
+	return c.channels
+}
+
+// requestForward asks the server to forward requestedHost (or a random host) to this client,
+// returning the host and the compression algorithm chosen from those offered
+func (c *Client) requestForward(requestedHost string, compression []string) (string, string, error) {
+	request := common.RemoteForwardRequest{
+		RequestedHost: requestedHost,
+	}
+
+	if c.extensions {
+		request.Extensions = common.MarshalExtensions(common.ForwardRequestExtensions{
+			Pool:        c.pool,
+			PoolCookie:  c.poolCookie,
+			Compression: strings.Join(compression, ","),
+		})
+	} else if c.pool != "" {
+		return "", "", ErrPoolUnsupported
+	}
+
+	payload := ssh.Marshal(request)
+
 	success, replyData, err := c.conn.SendRequest(common.HttpForward, true, payload)
 
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
 	if !success {
-		return "", errors.New(string(replyData))
+		return "", "", errors.New(string(replyData))
 	}
 
 	var response common.RemoteForwardSuccess
 
 	if err := ssh.Unmarshal(replyData, &response); err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	ch := c.conn.HandleChannelOpen(common.ForwardedHTTPChannelType)
+	var ext common.ForwardSuccessExtensions
 
-	go func() {
-		proxy.acceptConnections(ch)
+	if err := common.UnmarshalExtensions(response.Extensions, &ext); err != nil {
+		return "", "", err
+	}
 
-		payload := ssh.Marshal(common.RemoteForwardCancelRequest{Host: response.Host})
-		c.conn.SendRequest(common.CancelHttpForward, false, payload)
-	}()
+	logNotice(ext.Notice)
 
-	return response.Host, nil
+	return response.Host, ext.Compression, nil
+}
+
+// cancelForward tells the server to stop forwarding host
+func (c *Client) cancelForward(host string) {
+	payload := ssh.Marshal(common.RemoteForwardCancelRequest{Host: host})
+	c.conn.SendRequest(common.CancelHttpForward, false, payload)
+}
+
+// logNotice logs each line of a server notice as a warning
+func logNotice(notice string) {
+	if notice == "" {
+		return
+	}
+
+	for _, line := range strings.Split(notice, "\n") {
+		log.Warning(line)
+	}
 }
@@ -0,0 +1,112 @@
+package client
+
+import (
+	"errors"
+	"io/fs"
+	"net/http"
+	"path"
+)
+
+// WithDirectoryListing lists the contents of directories without an index.html on file backends
+func WithDirectoryListing() ProxyOption {
+	return func(p *proxyOptions) {
+		p.directoryListing = true
+	}
+}
+
+// WithSPAFallback serves the root index.html for missing paths on file backends, for single page apps using client side routing
+func WithSPAFallback() ProxyOption {
+	return func(p *proxyOptions) {
+		p.spaFallback = true
+	}
+}
+
+// NewFileProxy creates a new proxy serving the files in dir, with range requests and MIME types handled by net/http.
+func NewFileProxy(dir string, opts ...ProxyOption) *HandlerProxy {
+	options := newProxyOptions("", opts...)
+
+	return NewHandlerProxy(&fileHandler{
+		root:        http.Dir(dir),
+		fileServer:  http.FileServer(http.Dir(dir)),
+		listing:     options.directoryListing,
+		spaFallback: options.spaFallback,
+	})
+}
+
+// fileHandler serves files using http.FileServer, with optional directory listings and SPA fallback
+type fileHandler struct {
+	root        http.FileSystem
+	fileServer  http.Handler
+	listing     bool
+	spaFallback bool
+}
+
+func (h *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := path.Clean("/" + r.URL.Path)
+
+	if !h.exists(name) {
+		if h.spaFallback && h.exists("/index.html") {
+			h.serveIndex(w, r)
+			return
+		}
+
+		http.NotFound(w, r)
+		return
+	}
+
+	h.fileServer.ServeHTTP(w, r)
+}
+
+// exists checks if name is a file, or a directory with an index.html if listings are disabled
+func (h *fileHandler) exists(name string) bool {
+	f, err := h.root.Open(name)
+
+	if err != nil {
+		return false
+	}
+
+	defer f.Close()
+
+	stat, err := f.Stat()
+
+	if err != nil {
+		return false
+	}
+
+	if stat.IsDir() && !h.listing {
+		return h.exists(path.Join(name, "index.html"))
+	}
+
+	return true
+}
+
+// serveIndex serves the root index.html
+func (h *fileHandler) serveIndex(w http.ResponseWriter, r *http.Request) {
+	f, err := h.root.Open("/index.html")
+
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	defer f.Close()
+
+	stat, err := f.Stat()
+
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	http.ServeContent(w, r, "index.html", stat.ModTime(), f)
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// HandlerProxy is a proxy implementation serving forwarded requests with an http.Handler, without a local listener.
+type HandlerProxy struct {
+	handler http.Handler
+}
+
+// NewHandlerProxy creates a new proxy serving requests with handler
+func NewHandlerProxy(handler http.Handler) *HandlerProxy {
+	return &HandlerProxy{
+		handler: handler,
+	}
+}
+
+// Handle reads a request from the ssh channel and writes the handler's response to it
+func (p *HandlerProxy) Handle(rw io.ReadWriteCloser, data ChannelData) {
+	defer rw.Close()
+
+	req, err := http.ReadRequest(bufio.NewReader(rw))
+
+	if err != nil {
+		return
+	}
+
+	ctx, span := startForwardSpan(data, "gogrok.proxy")
+	defer span.End()
+
+	req = req.WithContext(ctx)
+	req.RemoteAddr = data.ClientIP
+
+	w := &channelResponseWriter{
+		w:      bufio.NewWriter(rw),
+		header: make(http.Header),
+	}
+
+	p.handler.ServeHTTP(w, req)
+
+	w.finish()
+}
+
+// channelResponseWriter writes an http response to a channel.
+// The channel is closed after each response, which delimits bodies without a Content-Length.
+type channelResponseWriter struct {
+	w           *bufio.Writer
+	header      http.Header
+	wroteHeader bool
+}
+
+func (w *channelResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *channelResponseWriter) WriteHeader(statusCode int) {
+	if w.wroteHeader {
+		return
+	}
+
+	w.wroteHeader = true
+
+	w.header.Set("Connection", "close")
+
+	fmt.Fprintf(w.w, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
+	w.header.Write(w.w)
+	w.w.WriteString("\r\n")
+}
+
+func (w *channelResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.header.Get("Content-Type") == "" && w.header.Get("Content-Encoding") == "" {
+			w.header.Set("Content-Type", http.DetectContentType(b))
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+
+	return w.w.Write(b)
+}
+
+// Flush sends buffered data to the channel
+func (w *channelResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+
+	w.w.Flush()
+}
+
+// finish writes the headers if the handler didn't write anything, and flushes the response
+func (w *channelResponseWriter) finish() {
+	w.Flush()
+}
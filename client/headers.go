@@ -0,0 +1,118 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var (
+	ErrInvalidHeader = errors.New("header must be in the form 'Name: value'")
+)
+
+// HeaderRules modify a set of headers.
+// Headers in Remove are removed first, then headers in Set replace existing values, and headers in Add are appended.
+type HeaderRules struct {
+	Add    http.Header
+	Set    http.Header
+	Remove []string
+}
+
+// NewHeaderRules creates empty header rules
+func NewHeaderRules() HeaderRules {
+	return HeaderRules{
+		Add: make(http.Header),
+		Set: make(http.Header),
+	}
+}
+
+// ParseHeader parses a header in the form "Name: value"
+func ParseHeader(header string) (string, string, error) {
+	idx := strings.Index(header, ":")
+
+	if idx < 1 {
+		return "", "", ErrInvalidHeader
+	}
+
+	return strings.TrimSpace(header[:idx]), strings.TrimSpace(header[idx+1:]), nil
+}
+
+// Empty checks if the rules don't modify anything
+func (r HeaderRules) Empty() bool {
+	return len(r.Add) == 0 && len(r.Set) == 0 && len(r.Remove) == 0
+}
+
+// Apply modifies headers using the rules
+func (r HeaderRules) Apply(headers http.Header) {
+	for _, name := range r.Remove {
+		headers.Del(name)
+	}
+
+	for name, values := range r.Set {
+		headers[http.CanonicalHeaderKey(name)] = append([]string(nil), values...)
+	}
+
+	for name, values := range r.Add {
+		for _, value := range values {
+			headers.Add(name, value)
+		}
+	}
+}
+
+// rewriteLocation replaces the backend host in an absolute Location header with the public host
+func rewriteLocation(headers http.Header, backendUrl *url.URL, publicScheme, publicHost string) {
+	location := headers.Get("Location")
+
+	if location == "" {
+		return
+	}
+
+	u, err := url.Parse(location)
+
+	if err != nil || !u.IsAbs() || !strings.EqualFold(u.Hostname(), backendUrl.Hostname()) {
+		return
+	}
+
+	u.Scheme = publicScheme
+	u.Host = publicHost
+
+	headers.Set("Location", u.String())
+}
+
+// rewriteCookieDomains replaces the backend host in Set-Cookie domain attributes with the public host
+func rewriteCookieDomains(headers http.Header, backendUrl *url.URL, publicHost string) {
+	cookies := headers.Values("Set-Cookie")
+
+	if len(cookies) == 0 {
+		return
+	}
+
+	backendHost := backendUrl.Hostname()
+
+	rewritten := make([]string, len(cookies))
+
+	for i, cookie := range cookies {
+		attributes := strings.Split(cookie, ";")
+
+		for j, attribute := range attributes {
+			name, value := attribute, ""
+
+			if idx := strings.Index(attribute, "="); idx != -1 {
+				name, value = attribute[:idx], attribute[idx+1:]
+			}
+
+			if !strings.EqualFold(strings.TrimSpace(name), "domain") {
+				continue
+			}
+
+			if strings.EqualFold(strings.TrimPrefix(strings.TrimSpace(value), "."), backendHost) {
+				attributes[j] = " Domain=" + publicHost
+			}
+		}
+
+		rewritten[i] = strings.Join(attributes, ";")
+	}
+
+	headers["Set-Cookie"] = rewritten
+}
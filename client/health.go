@@ -0,0 +1,133 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gogrok.ccatss.dev/common"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DefaultHealthInterval is the interval between health checks when none is set
+const DefaultHealthInterval = 10 * time.Second
+
+// HealthChecker is implemented by proxies which can probe their backend.
+// path is the http path requested from http backends.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context, path string) error
+}
+
+// WithHealthCheck probes path on the backend every interval, reporting its health to the server.
+// While unhealthy, the server answers visitors itself, or routes them to a healthy member of the host's pool.
+func WithHealthCheck(path string, interval time.Duration) Option {
+	return func(c *Client) {
+		c.healthPath = path
+		c.healthInterval = interval
+	}
+}
+
+// CheckHealth requests path from the backend, which is healthy when it responds with a 2xx or 3xx status
+func (p *HTTPProxy) CheckHealth(ctx context.Context, path string) error {
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return p.dial(ChannelData{})
+	}
+
+	transport := &http.Transport{
+		DialContext:       dial,
+		DialTLSContext:    dial,
+		DisableKeepAlives: true,
+	}
+
+	u := *p.backendUrl
+	u.Path = path
+
+	// Connections are upgraded to TLS by dial
+	if u.Scheme == "wss" {
+		u.Scheme = "https"
+	} else if u.Scheme == "ws" {
+		u.Scheme = "http"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+
+	if err != nil {
+		return err
+	}
+
+	res, err := transport.RoundTrip(req)
+
+	if err != nil {
+		return err
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("health check returned %s", res.Status)
+	}
+
+	return nil
+}
+
+// CheckHealth connects to the backend, ignoring path
+func (p *StreamProxy) CheckHealth(ctx context.Context, path string) error {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, p.network, p.address)
+
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// monitorHealth checks the backend of host until done is closed, reporting each change in health to the server
+func (c *Client) monitorHealth(checker HealthChecker, host string, done <-chan struct{}) {
+	interval := c.healthInterval
+
+	if interval <= 0 {
+		interval = DefaultHealthInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// The server considers new forwards healthy
+	healthy := true
+
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		err := checker.CheckHealth(ctx, c.healthPath)
+		cancel()
+
+		if (err == nil) != healthy {
+			healthy = err == nil
+
+			report := common.HealthReport{
+				Host:    host,
+				Healthy: healthy,
+			}
+
+			if err != nil {
+				report.Message = err.Error()
+				log.WithError(err).WithField("host", host).Warning("Backend is unhealthy")
+			} else {
+				log.WithField("host", host).Info("Backend is healthy")
+			}
+
+			if _, _, err := c.conn.SendRequest(common.HttpHealth, true, ssh.Marshal(report)); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
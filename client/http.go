@@ -3,7 +3,12 @@ package client
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"gogrok.ccatss.dev/common"
 	"golang.org/x/crypto/ssh"
 	"io"
 	"net"
@@ -11,38 +16,191 @@ import (
 	"net/textproto"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 )
 
+// Proxy handles forwarded connections.
+// data contains the forwarded host and the visitor's address.
 type Proxy interface {
-	Handle(rw io.ReadWriteCloser)
+	Handle(rw io.ReadWriteCloser, data ChannelData)
+}
+
+// ChannelData describes a forwarded connection, including optional fields sent by servers supporting protocol extensions
+type ChannelData struct {
+	Host     string
+	ClientIP string
+
+	common.ChannelDataExtensions
+}
+
+// parseChannelData parses the data sent when the server opens a forwarded channel
+func parseChannelData(extraData []byte) (ChannelData, error) {
+	var msg common.RemoteForwardChannelData
+
+	if err := ssh.Unmarshal(extraData, &msg); err != nil {
+		return ChannelData{}, err
+	}
+
+	data := ChannelData{
+		Host:     msg.Host,
+		ClientIP: msg.ClientIP,
+	}
+
+	return data, common.UnmarshalExtensions(msg.Extensions, &data.ChannelDataExtensions)
 }
 
 // HTTPProxy is a proxy implementation to pass http requests.
 type HTTPProxy struct {
+	network    string
 	dialHost   string
 	backendUrl *url.URL
-	tlsConfig  *tls.Config
+
+	proxyOptions
+}
+
+// proxyOptions are the options of the proxies created by Client.Start.
+// Each proxy uses the options relevant to its backend.
+type proxyOptions struct {
+	tlsConfig *tls.Config
+
+	requestHeaders  HeaderRules
+	responseHeaders HeaderRules
+	preserveHost    bool
+	rewriteLocation bool
+	rewriteCookies  bool
+
+	directoryListing bool
+	spaFallback      bool
+
+	proxyProtocol int
+
+	observer RequestObserver
+}
+
+// ProxyOption represents a func used to assign options to a proxy
+type ProxyOption func(p *proxyOptions)
+
+// newProxyOptions applies opts to the default options, where https backends are accepted without verification.
+// TLS options are accepted by every proxy, and ignored by proxies without TLS backends.
+func newProxyOptions(serverName string, opts ...ProxyOption) proxyOptions {
+	options := proxyOptions{
+		tlsConfig: &tls.Config{ServerName: serverName, InsecureSkipVerify: true},
+	}
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	return options
+}
+
+// WithRequestHeaders sets rules modifying the headers of requests sent to the backend
+func WithRequestHeaders(rules HeaderRules) ProxyOption {
+	return func(p *proxyOptions) {
+		p.requestHeaders = rules
+	}
+}
+
+// WithResponseHeaders sets rules modifying the headers of responses returned from the backend
+func WithResponseHeaders(rules HeaderRules) ProxyOption {
+	return func(p *proxyOptions) {
+		p.responseHeaders = rules
+	}
+}
+
+// WithPreserveHost passes the public Host header to the backend instead of the backend host
+func WithPreserveHost() ProxyOption {
+	return func(p *proxyOptions) {
+		p.preserveHost = true
+	}
+}
+
+// WithLocationRewrite replaces the backend host in Location headers with the public host
+func WithLocationRewrite() ProxyOption {
+	return func(p *proxyOptions) {
+		p.rewriteLocation = true
+	}
+}
+
+// WithCookieRewrite replaces the backend host in Set-Cookie domains with the public host
+func WithCookieRewrite() ProxyOption {
+	return func(p *proxyOptions) {
+		p.rewriteCookies = true
+	}
+}
+
+// WithTLSVerify verifies the certificates of https backends, which are accepted without verification by default
+func WithTLSVerify() ProxyOption {
+	return func(p *proxyOptions) {
+		p.tlsConfig.InsecureSkipVerify = false
+	}
+}
+
+// WithRootCAs verifies the certificates of https backends against pool instead of the system roots
+func WithRootCAs(pool *x509.CertPool) ProxyOption {
+	return func(p *proxyOptions) {
+		p.tlsConfig.RootCAs = pool
+		p.tlsConfig.InsecureSkipVerify = false
+	}
 }
 
-// NewHTTPProxy parses the backend url and creates a new proxy for it
-func NewHTTPProxy(backendUrl *url.URL) *HTTPProxy {
-	host, port, _ := net.SplitHostPort(backendUrl.Host)
+// WithServerName overrides the server name sent using SNI and verified against the backend certificate
+func WithServerName(serverName string) ProxyOption {
+	return func(p *proxyOptions) {
+		p.tlsConfig.ServerName = serverName
+	}
+}
 
-	if port == "" {
-		port = "80"
+// WithClientCertificate presents a client certificate to https backends requiring mutual TLS
+func WithClientCertificate(cert tls.Certificate) ProxyOption {
+	return func(p *proxyOptions) {
+		p.tlsConfig.Certificates = []tls.Certificate{cert}
 	}
+}
 
-	tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: true}
-	dialHost := net.JoinHostPort(host, port)
+// NewHTTPProxy parses the backend url and creates a new proxy for it.
+// Backends listening on a unix socket use the http+unix or https+unix schemes, for example http+unix:///run/app.sock
+func NewHTTPProxy(backendUrl *url.URL, opts ...ProxyOption) *HTTPProxy {
+	network, dialHost := "tcp", backendUrl.Host
+	host := backendUrl.Hostname()
+
+	if isUnixScheme(backendUrl.Scheme) {
+		network, dialHost = "unix", localPath(backendUrl)
+		host = "localhost"
+
+		// Backends behind a socket see localhost as their host
+		backendUrl = &url.URL{Scheme: strings.TrimSuffix(backendUrl.Scheme, "+unix"), Host: host}
+	} else if backendUrl.Port() == "" {
+		port := "80"
+
+		if backendUrl.Scheme == "https" || backendUrl.Scheme == "wss" {
+			port = "443"
+		}
+
+		dialHost = net.JoinHostPort(host, port)
+	}
 
 	return &HTTPProxy{
-		dialHost:   dialHost,
-		backendUrl: backendUrl,
-		tlsConfig:  tlsConfig,
+		network:      network,
+		dialHost:     dialHost,
+		backendUrl:   backendUrl,
+		proxyOptions: newProxyOptions(host, opts...),
 	}
 }
 
-func (p *HTTPProxy) acceptConnections(ch <-chan ssh.NewChannel) {
+// isUnixScheme checks if scheme is a http scheme over a unix socket
+func isUnixScheme(scheme string) bool {
+	return scheme == "http+unix" || scheme == "https+unix"
+}
+
+// localPath returns the path of a unix socket or file backend url, which may be relative (unix://./app.sock)
+func localPath(u *url.URL) string {
+	return u.Host + u.Path
+}
+
+// acceptConnections accepts forwarded channels and passes them to proxy, compressed using compression if set
+func acceptConnections(proxy Proxy, ch <-chan ssh.NewChannel, compression string) {
 	for {
 		newCh := <-ch
 
@@ -59,36 +217,75 @@ func (p *HTTPProxy) acceptConnections(ch <-chan ssh.NewChannel) {
 
 		go ssh.DiscardRequests(r)
 
-		go p.Handle(ch)
+		data, _ := parseChannelData(newCh.ExtraData())
+
+		if compression == "" {
+			go proxy.Handle(ch, data)
+			continue
+		}
+
+		stream, err := common.CompressStream(ch, compression)
+
+		if err != nil {
+			log.WithError(err).Warning("Unable to compress channel")
+			ch.Close()
+			continue
+		}
+
+		go proxy.Handle(stream, data)
 	}
 }
 
 // Handle a request from the ssh channel and forwards it to the local http server
-func (p *HTTPProxy) Handle(rw io.ReadWriteCloser) {
-	tcpConn, err := net.Dial("tcp", p.dialHost)
+func (p *HTTPProxy) Handle(rw io.ReadWriteCloser, data ChannelData) {
+	defer rw.Close()
 
-	if err != nil {
-		rw.Close()
-		return
+	ctx, span := startForwardSpan(data, "gogrok.proxy")
+	defer span.End()
+
+	event := RequestEvent{
+		RequestID:  data.RequestID,
+		RemoteAddr: data.ClientIP,
+		Start:      time.Now(),
 	}
 
-	if p.backendUrl.Scheme == "https" || p.backendUrl.Scheme == "wss" {
-		// Wrap with TLS
-		tcpConn = tls.Client(tcpConn, p.tlsConfig)
+	if p.observer != nil {
+		defer func() {
+			event.Duration = time.Since(event.Start)
+			p.observer(event)
+		}()
 	}
 
-	defer rw.Close()
-	defer tcpConn.Close()
+	logger := log.WithField("requestId", data.RequestID)
 
 	bufferedCh := bufio.NewReader(rw)
 
 	tp := textproto.NewReader(bufferedCh)
 
-	var s string
-	if s, err = tp.ReadLine(); err != nil {
+	s, err := tp.ReadLine()
+
+	if err != nil {
+		event.Err = err
+		return
+	}
+
+	event.Method, event.Path = parseRequestLine(s)
+
+	_, dialSpan := tracer.Start(ctx, "gogrok.backend.dial")
+
+	tcpConn, err := p.dial(data)
+
+	endSpan(dialSpan, err)
+
+	if err != nil {
+		logger.WithError(err).Warning("Unable to connect to backend")
+		span.SetStatus(codes.Error, "unable to connect to backend")
+		event.Err = err
 		return
 	}
 
+	defer tcpConn.Close()
+
 	// Write the first response line as-is
 	tcpConn.Write([]byte(s + "\r\n"))
 
@@ -101,7 +298,21 @@ func (p *HTTPProxy) Handle(rw io.ReadWriteCloser) {
 
 	// Modify and return our headers
 	headers := http.Header(mimeHeader)
-	headers.Set("Host", p.backendUrl.Host)
+	publicHost := headers.Get("Host")
+	publicScheme := "http"
+
+	if proto := headers.Get("X-Forwarded-Proto"); proto != "" {
+		publicScheme = proto
+	}
+
+	if !p.preserveHost {
+		headers.Set("Host", p.backendUrl.Host)
+	}
+
+	// Continue the trace from our span in the backend
+	propagator.Inject(ctx, propagation.HeaderCarrier(headers))
+
+	p.requestHeaders.Apply(headers)
 	headers.Write(tcpConn)
 
 	// End headers
@@ -114,11 +325,120 @@ func (p *HTTPProxy) Handle(rw io.ReadWriteCloser) {
 		_, err := io.Copy(tcpConn, io.LimitReader(bufferedCh, int64(contentLength)))
 
 		if err != nil {
-			log.WithError(err).Warning("Connection error on body read, closing")
+			logger.WithError(err).Warning("Connection error on body read, closing")
+			event.Err = err
 			return
 		}
 	}
 
-	// Copy the response back to the tunnel server
-	io.Copy(rw, tcpConn)
+	bufferedConn := bufio.NewReader(tcpConn)
+
+	_, responseSpan := tracer.Start(ctx, "gogrok.backend.response")
+
+	statusCode, err := p.writeResponseHead(rw, bufferedConn, publicScheme, publicHost)
+
+	if statusCode != 0 {
+		responseSpan.SetAttributes(semconv.HTTPStatusCodeKey.Int(statusCode))
+	}
+
+	endSpan(responseSpan, err)
+
+	event.Status = statusCode
+
+	if err != nil {
+		event.Err = err
+		return
+	}
+
+	// Copy the response body back to the tunnel server
+	io.Copy(rw, bufferedConn)
+}
+
+// writeResponseHead reads the response line and headers from the backend, and writes them to the tunnel with the response rules applied
+// The response's status code is returned.
+func (p *HTTPProxy) writeResponseHead(w io.Writer, r *bufio.Reader, publicScheme, publicHost string) (int, error) {
+	tp := textproto.NewReader(r)
+
+	s, err := tp.ReadLine()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var statusCode int
+
+	if fields := strings.SplitN(s, " ", 3); len(fields) > 1 {
+		statusCode, _ = strconv.Atoi(fields[1])
+	}
+
+	mimeHeader, err := tp.ReadMIMEHeader()
+
+	if err != nil {
+		return statusCode, err
+	}
+
+	headers := http.Header(mimeHeader)
+
+	if publicHost != "" {
+		if p.rewriteLocation {
+			rewriteLocation(headers, p.backendUrl, publicScheme, publicHost)
+		}
+
+		if p.rewriteCookies {
+			rewriteCookieDomains(headers, p.backendUrl, stripPort(publicHost))
+		}
+	}
+
+	p.responseHeaders.Apply(headers)
+
+	if _, err := io.WriteString(w, s+"\r\n"); err != nil {
+		return statusCode, err
+	}
+
+	if err := headers.Write(w); err != nil {
+		return statusCode, err
+	}
+
+	_, err = io.WriteString(w, "\r\n")
+
+	return statusCode, err
+}
+
+// dial connects to the backend, sending the PROXY protocol header and starting TLS if enabled
+func (p *HTTPProxy) dial(data ChannelData) (net.Conn, error) {
+	conn, err := net.Dial(p.network, p.dialHost)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if p.proxyProtocol != 0 {
+		if err := writeProxyHeader(conn, p.proxyProtocol, data.ClientIP); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	if p.backendUrl.Scheme == "https" || p.backendUrl.Scheme == "wss" {
+		// Wrap with TLS
+		tlsConn := tls.Client(conn, p.tlsConfig)
+
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		return tlsConn, nil
+	}
+
+	return conn, nil
+}
+
+// stripPort removes the port from a host
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+
+	return host
 }
@@ -0,0 +1,375 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrAlreadyForwarding = errors.New("client is already forwarding")
+)
+
+// ListenOption represents a func used to assign options to a Listen call
+type ListenOption func(o *listenOptions)
+
+type listenOptions struct {
+	requestedHost string
+}
+
+// WithRequestedHost requests a specific host instead of a random host
+func WithRequestedHost(host string) ListenOption {
+	return func(o *listenOptions) {
+		o.requestedHost = host
+	}
+}
+
+// Listen forwards a host to this client, returning a net.Listener accepting each forwarded connection.
+// The public host is returned by the listener's Addr. The forward is cancelled when the listener is closed or ctx is done.
+// A client can only forward one host at a time, using either Listen or Start, and may Listen again once the listener is closed.
+func (c *Client) Listen(ctx context.Context, opts ...ListenOption) (net.Listener, error) {
+	var options listenOptions
+
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if err := c.Open(); err != nil {
+		return nil, err
+	}
+
+	if !atomic.CompareAndSwapInt32(&c.forwarding, 0, 1) {
+		return nil, ErrAlreadyForwarding
+	}
+
+	ch := c.forwardedChannels()
+
+	if ch == nil {
+		atomic.StoreInt32(&c.forwarding, 0)
+		return nil, ErrAlreadyForwarding
+	}
+
+	// Listeners pass channels to callers as-is, so compression isn't offered
+	host, _, err := c.requestForward(options.requestedHost, nil)
+
+	if err != nil {
+		atomic.StoreInt32(&c.forwarding, 0)
+		return nil, err
+	}
+
+	l := &listener{
+		client: c,
+		addr:   tunnelAddr(host),
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+
+	go l.acceptChannels(ch)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			l.Close()
+		case <-l.done:
+		}
+	}()
+
+	return l, nil
+}
+
+// ServeHTTP forwards a host to this client and serves its requests with handler until ctx is done, returning the public host.
+func (c *Client) ServeHTTP(ctx context.Context, handler http.Handler, opts ...ListenOption) (string, error) {
+	l, err := c.Listen(ctx, opts...)
+
+	if err != nil {
+		return "", err
+	}
+
+	go http.Serve(l, handler)
+
+	return l.Addr().String(), nil
+}
+
+// tunnelAddr is the public host of a forward
+type tunnelAddr string
+
+func (a tunnelAddr) Network() string {
+	return "gogrok"
+}
+
+func (a tunnelAddr) String() string {
+	return string(a)
+}
+
+// listener accepts forwarded channels as connections
+type listener struct {
+	client *Client
+	addr   tunnelAddr
+	conns  chan net.Conn
+	done   chan struct{}
+	once   sync.Once
+}
+
+// acceptChannels accepts forwarded channels until the listener or the ssh connection is closed,
+// leaving later channels to the client's next listener
+func (l *listener) acceptChannels(ch <-chan ssh.NewChannel) {
+	for {
+		var newCh ssh.NewChannel
+
+		select {
+		case newCh = <-ch:
+		case <-l.done:
+			return
+		}
+
+		if newCh == nil {
+			break
+		}
+
+		channel, reqs, err := newCh.Accept()
+
+		if err != nil {
+			continue
+		}
+
+		go ssh.DiscardRequests(reqs)
+
+		conn := newChannelConn(channel, l.addr, remoteAddr(newCh.ExtraData()))
+
+		select {
+		case l.conns <- conn:
+		case <-l.done:
+			conn.Close()
+		}
+	}
+
+	l.Close()
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections and cancels the forward, allowing the client to forward another host
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+
+		l.client.cancelForward(l.addr.String())
+
+		atomic.StoreInt32(&l.client.forwarding, 0)
+	})
+
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return l.addr
+}
+
+// remoteAddr returns the visitor address sent with a forwarded channel
+func remoteAddr(extraData []byte) net.Addr {
+	data, err := parseChannelData(extraData)
+
+	if err != nil {
+		return tunnelAddr("")
+	}
+
+	if addr, err := net.ResolveTCPAddr("tcp", data.ClientIP); err == nil {
+		return addr
+	}
+
+	return tunnelAddr(data.ClientIP)
+}
+
+// channelConn is a net.Conn over an ssh channel.
+// Channels don't support deadlines, so reads are passed through a goroutine which read deadlines can interrupt.
+// Write deadlines are ignored.
+type channelConn struct {
+	ssh.Channel
+
+	localAddr  net.Addr
+	remoteAddr net.Addr
+
+	chunks  chan []byte
+	pending []byte
+	readErr error
+	readMu  sync.Mutex
+
+	readDeadline *deadline
+	done         chan struct{}
+	once         sync.Once
+}
+
+func newChannelConn(channel ssh.Channel, localAddr, remoteAddr net.Addr) *channelConn {
+	c := &channelConn{
+		Channel:      channel,
+		localAddr:    localAddr,
+		remoteAddr:   remoteAddr,
+		chunks:       make(chan []byte),
+		readDeadline: newDeadline(),
+		done:         make(chan struct{}),
+	}
+
+	go c.readChannel()
+
+	return c
+}
+
+// readChannel reads from the channel until it's closed, passing data to Read
+func (c *channelConn) readChannel() {
+	defer close(c.chunks)
+
+	for {
+		buf := make([]byte, 32*1024)
+
+		n, err := c.Channel.Read(buf)
+
+		if n > 0 {
+			select {
+			case c.chunks <- buf[:n]:
+			case <-c.done:
+				return
+			}
+		}
+
+		if err != nil {
+			c.readErr = err
+			return
+		}
+	}
+}
+
+func (c *channelConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	if len(c.pending) == 0 {
+		select {
+		case chunk, ok := <-c.chunks:
+			if !ok {
+				if c.readErr == nil {
+					return 0, io.EOF
+				}
+
+				return 0, c.readErr
+			}
+
+			c.pending = chunk
+		case <-c.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.done:
+			return 0, net.ErrClosed
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+
+	return n, nil
+}
+
+func (c *channelConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+
+	return c.Channel.Close()
+}
+
+func (c *channelConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *channelConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *channelConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *channelConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+func (c *channelConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// deadline is a cancellation channel closed when a deadline passes
+type deadline struct {
+	timer  *time.Timer
+	cancel chan struct{}
+	sync.Mutex
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set the deadline, where a zero time clears it
+func (d *deadline) set(t time.Time) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer fired, wait for the cancel channel to be closed
+		<-d.cancel
+	}
+
+	d.timer = nil
+
+	closed := false
+
+	select {
+	case <-d.cancel:
+		closed = true
+	default:
+	}
+
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+
+		cancel := d.cancel
+
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel closed once the deadline passes
+func (d *deadline) wait() chan struct{} {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.cancel
+}
@@ -0,0 +1,142 @@
+package client
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"gogrok.ccatss.dev/common"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net"
+	"testing"
+)
+
+// testSigner generates a signer
+func testSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer, err := ssh.NewSignerFromKey(priv)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer
+}
+
+// testServer accepts a single connection, forwarding each requested host and passing the connection to forwards
+func testServer(t *testing.T, forwards chan<- *ssh.ServerConn) string {
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(testSigner(t))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		l.Close()
+	})
+
+	go func() {
+		c, err := l.Accept()
+
+		if err != nil {
+			return
+		}
+
+		conn, chans, reqs, err := ssh.NewServerConn(c, config)
+
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for newCh := range chans {
+				newCh.Reject(ssh.UnknownChannelType, "unsupported")
+			}
+		}()
+
+		for req := range reqs {
+			switch req.Type {
+			case common.HttpForward:
+				var payload common.RemoteForwardRequest
+
+				ssh.Unmarshal(req.Payload, &payload)
+
+				req.Reply(true, ssh.Marshal(common.RemoteForwardSuccess{Host: payload.RequestedHost}))
+
+				forwards <- conn
+			case common.CancelHttpForward:
+				req.Reply(true, nil)
+			default:
+				req.Reply(false, nil)
+			}
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// openForwardedChannel opens a forwarded channel for host and writes data to it
+func openForwardedChannel(t *testing.T, conn *ssh.ServerConn, host, data string) {
+	channel, reqs, err := conn.OpenChannel(common.ForwardedHTTPChannelType, ssh.Marshal(common.RemoteForwardChannelData{
+		Host:     host,
+		ClientIP: "127.0.0.1:1234",
+	}))
+
+	if err != nil {
+		t.Errorf("forwarded channel for %s was rejected: %v", host, err)
+		return
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	channel.Write([]byte(data))
+	channel.Close()
+}
+
+func TestListenAfterClose(t *testing.T) {
+	forwards := make(chan *ssh.ServerConn, 1)
+
+	c := New(testServer(t, forwards), testSigner(t))
+	defer c.Close()
+
+	for _, host := range []string{"first.example.com", "second.example.com"} {
+		l, err := c.Listen(context.Background(), WithRequestedHost(host))
+
+		if err != nil {
+			t.Fatalf("Listen(%s) returned error: %v", host, err)
+		}
+
+		if l.Addr().String() != host {
+			t.Errorf("listener address = %s, expected %s", l.Addr(), host)
+		}
+
+		if _, err := c.Listen(context.Background()); err != ErrAlreadyForwarding {
+			t.Errorf("second Listen while forwarding returned %v, expected %v", err, ErrAlreadyForwarding)
+		}
+
+		go openForwardedChannel(t, <-forwards, host, host)
+
+		conn, err := l.Accept()
+
+		if err != nil {
+			t.Fatalf("Accept on %s returned error: %v", host, err)
+		}
+
+		data, err := io.ReadAll(conn)
+
+		if err != nil || string(data) != host {
+			t.Errorf("read %q, %v from %s, expected %q", data, err, host, host)
+		}
+
+		conn.Close()
+		l.Close()
+	}
+}
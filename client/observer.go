@@ -0,0 +1,41 @@
+package client
+
+import (
+	"strings"
+	"time"
+)
+
+// RequestEvent describes a request passed through a proxy
+// Status is 0 and Err is set when the backend couldn't be reached or didn't respond.
+type RequestEvent struct {
+	RequestID  string
+	RemoteAddr string
+	Method     string
+	Path       string
+	Status     int
+	Start      time.Time
+	Duration   time.Duration
+	Err        error
+}
+
+// RequestObserver is called after each request passed through a proxy has completed
+type RequestObserver func(event RequestEvent)
+
+// WithRequestObserver calls observer after each request passed to http backends, for example to display or record traffic.
+// Observers are called concurrently.
+func WithRequestObserver(observer RequestObserver) ProxyOption {
+	return func(p *proxyOptions) {
+		p.observer = observer
+	}
+}
+
+// parseRequestLine parses "GET /path HTTP/1.1" into its method and path
+func parseRequestLine(line string) (method, path string) {
+	parts := strings.SplitN(line, " ", 3)
+
+	if len(parts) < 2 {
+		return "", ""
+	}
+
+	return parts[0], parts[1]
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/codes"
+	"gogrok.ccatss.dev/proxyproto"
+	"io"
+	"net"
+)
+
+// StreamProxy is a proxy implementation passing the raw stream of each forwarded connection to a backend.
+// Requests and responses are passed as-is, without any header rewriting.
+type StreamProxy struct {
+	network string
+	address string
+
+	proxyOptions
+}
+
+// NewStreamProxy creates a new proxy dialing address on network (tcp or unix) for each connection
+func NewStreamProxy(network, address string, opts ...ProxyOption) *StreamProxy {
+	return &StreamProxy{
+		network:      network,
+		address:      address,
+		proxyOptions: newProxyOptions("", opts...),
+	}
+}
+
+// Handle copies data between the ssh channel and a new backend connection until either side closes
+func (p *StreamProxy) Handle(rw io.ReadWriteCloser, data ChannelData) {
+	defer rw.Close()
+
+	ctx, span := startForwardSpan(data, "gogrok.proxy")
+	defer span.End()
+
+	logger := log.WithField("requestId", data.RequestID)
+
+	_, dialSpan := tracer.Start(ctx, "gogrok.backend.dial")
+
+	conn, err := net.Dial(p.network, p.address)
+
+	if err == nil && p.proxyProtocol != 0 {
+		if err = writeProxyHeader(conn, p.proxyProtocol, data.ClientIP); err != nil {
+			conn.Close()
+		}
+	}
+
+	endSpan(dialSpan, err)
+
+	if err != nil {
+		logger.WithError(err).WithField("address", p.address).Warning("Unable to connect to backend")
+		span.SetStatus(codes.Error, "unable to connect to backend")
+		return
+	}
+
+	defer conn.Close()
+
+	go func() {
+		io.Copy(conn, rw)
+	}()
+
+	io.Copy(rw, conn)
+}
+
+// WithProxyProtocol sends a PROXY protocol header (version 1 or 2) with the visitor's address to tcp and http backends
+func WithProxyProtocol(version int) ProxyOption {
+	return func(p *proxyOptions) {
+		p.proxyProtocol = version
+	}
+}
+
+// writeProxyHeader writes a PROXY protocol header from clientIP to a backend connection.
+// Visitors without a known address are sent as local connections.
+func writeProxyHeader(conn net.Conn, version int, clientIP string) error {
+	source, _ := net.ResolveTCPAddr("tcp", clientIP)
+
+	_, err := proxyproto.NewHeader(version, source, conn.RemoteAddr()).WriteTo(conn)
+
+	return err
+}
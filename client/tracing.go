@@ -0,0 +1,42 @@
+package client
+
+import (
+	"context"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	tracer     = otel.Tracer("gogrok.ccatss.dev/client")
+	propagator = propagation.TraceContext{}
+
+	// requestIDKey is the span attribute containing the request id
+	requestIDKey = attribute.Key("gogrok.request_id")
+)
+
+// startForwardSpan starts the span of a forwarded connection, continuing the server's trace
+func startForwardSpan(data ChannelData, name string) (context.Context, trace.Span) {
+	ctx := propagator.Extract(context.Background(), propagation.MapCarrier{"traceparent": data.TraceParent})
+
+	return tracer.Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("gogrok.host", data.Host),
+			attribute.String("gogrok.client_ip", data.ClientIP),
+			requestIDKey.String(data.RequestID),
+		),
+	)
+}
+
+// endSpan records err on span if set, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -17,12 +19,37 @@ import (
 )
 
 var (
-	ErrNoEndpoint = errors.New("no http(s) endpoint provided")
+	ErrNoEndpoint           = errors.New("no http(s) endpoint provided")
+	ErrNoCertificates       = errors.New("no certificates found in CA bundle")
+	ErrInvalidProxyProtocol = errors.New("PROXY protocol version must be 1 or 2")
 )
 
 func init() {
 	clientCmd.Flags().String("server", "localhost:2222", "Gogrok Server Address")
 	clientCmd.Flags().String("host", "", "Requested host to register")
+	clientCmd.Flags().StringSlice("request-header-add", nil, "Header to add to requests (e.g. 'X-Tunnel: gogrok')")
+	clientCmd.Flags().StringSlice("request-header-set", nil, "Header to replace in requests")
+	clientCmd.Flags().StringSlice("request-header-remove", nil, "Header name to remove from requests")
+	clientCmd.Flags().StringSlice("response-header-add", nil, "Header to add to responses")
+	clientCmd.Flags().StringSlice("response-header-set", nil, "Header to replace in responses")
+	clientCmd.Flags().StringSlice("response-header-remove", nil, "Header name to remove from responses")
+	clientCmd.Flags().Bool("preserve-host", false, "Pass the public Host header to the backend")
+	clientCmd.Flags().Bool("rewrite-location", false, "Rewrite backend hosts in Location headers to the public host")
+	clientCmd.Flags().Bool("rewrite-cookies", false, "Rewrite backend hosts in Set-Cookie domains to the public host")
+	clientCmd.Flags().Bool("file-listing", false, "List directories without an index.html on file:// backends")
+	clientCmd.Flags().Bool("spa", false, "Serve the root index.html for missing paths on file:// backends")
+	clientCmd.Flags().Int("proxy-protocol", 0, "Send a PROXY protocol header (version 1 or 2) with the visitor address to the backend")
+	clientCmd.Flags().String("pool", "", "Share the host with other clients, distributing requests using round-robin, least-inflight, hash-ip or hash-cookie")
+	clientCmd.Flags().String("pool-cookie", "", "Cookie hashed for sticky sessions by hash-cookie pools")
+	clientCmd.Flags().String("health-check", "", "Path probed on the backend to report its health to the server (e.g. /healthz)")
+	clientCmd.Flags().Duration("health-interval", client.DefaultHealthInterval, "Interval between backend health checks")
+	clientCmd.Flags().StringSlice("compression", nil, "Compression algorithms offered for tunneled traffic, in order of preference (zstd, gzip)")
+	clientCmd.Flags().Bool("dashboard", false, "Show a live dashboard of the session and requests, or request lines when output isn't a terminal")
+	clientCmd.Flags().Bool("tls-verify", false, "Verify the certificate of https backends")
+	clientCmd.Flags().String("tls-ca", "", "CA bundle used to verify https backends, implies --tls-verify")
+	clientCmd.Flags().String("tls-server-name", "", "Server name sent to and verified against https backends")
+	clientCmd.Flags().String("tls-cert", "", "Client certificate presented to https backends")
+	clientCmd.Flags().String("tls-key", "", "Client certificate key, if not bundled with the certificate")
 	rootCmd.AddCommand(clientCmd)
 }
 
@@ -56,6 +83,150 @@ func loadClientKey() ssh.Signer {
 	return signer
 }
 
+// loadProxyOptions loads header rules and rewrite options from the configuration
+func loadProxyOptions() ([]client.ProxyOption, error) {
+	proxyOpts := make([]client.ProxyOption, 0)
+
+	requestRules, err := loadHeaderRules("gogrok.requestHeader")
+
+	if err != nil {
+		return nil, err
+	}
+
+	responseRules, err := loadHeaderRules("gogrok.responseHeader")
+
+	if err != nil {
+		return nil, err
+	}
+
+	proxyOpts = append(proxyOpts, client.WithRequestHeaders(requestRules), client.WithResponseHeaders(responseRules))
+
+	if viper.GetBool("gogrok.preserveHost") {
+		proxyOpts = append(proxyOpts, client.WithPreserveHost())
+	}
+
+	if viper.GetBool("gogrok.rewriteLocation") {
+		proxyOpts = append(proxyOpts, client.WithLocationRewrite())
+	}
+
+	if viper.GetBool("gogrok.rewriteCookies") {
+		proxyOpts = append(proxyOpts, client.WithCookieRewrite())
+	}
+
+	if viper.GetBool("gogrok.fileListing") {
+		proxyOpts = append(proxyOpts, client.WithDirectoryListing())
+	}
+
+	if viper.GetBool("gogrok.spaFallback") {
+		proxyOpts = append(proxyOpts, client.WithSPAFallback())
+	}
+
+	switch version := viper.GetInt("gogrok.proxyProtocolVersion"); version {
+	case 0:
+	case 1, 2:
+		proxyOpts = append(proxyOpts, client.WithProxyProtocol(version))
+	default:
+		return nil, ErrInvalidProxyProtocol
+	}
+
+	tlsOpts, err := loadTLSOptions(afero.NewOsFs())
+
+	if err != nil {
+		return nil, err
+	}
+
+	return append(proxyOpts, tlsOpts...), nil
+}
+
+// loadTLSOptions loads the backend TLS verification and client certificate options
+func loadTLSOptions(fs afero.Fs) ([]client.ProxyOption, error) {
+	proxyOpts := make([]client.ProxyOption, 0)
+
+	if viper.GetBool("gogrok.tlsVerify") {
+		proxyOpts = append(proxyOpts, client.WithTLSVerify())
+	}
+
+	if caFile := viper.GetString("gogrok.tlsCA"); caFile != "" {
+		caData, err := afero.ReadFile(fs, caFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+
+		if !pool.AppendCertsFromPEM(caData) {
+			return nil, ErrNoCertificates
+		}
+
+		proxyOpts = append(proxyOpts, client.WithRootCAs(pool))
+	}
+
+	if serverName := viper.GetString("gogrok.tlsServerName"); serverName != "" {
+		proxyOpts = append(proxyOpts, client.WithServerName(serverName))
+	}
+
+	certFile, keyFile := viper.GetString("gogrok.tlsCert"), viper.GetString("gogrok.tlsKey")
+
+	if certFile != "" {
+		// The key may be bundled with the certificate
+		if keyFile == "" {
+			keyFile = certFile
+		}
+
+		certData, err := afero.ReadFile(fs, certFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		keyData, err := afero.ReadFile(fs, keyFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		cert, err := tls.X509KeyPair(certData, keyData)
+
+		if err != nil {
+			return nil, err
+		}
+
+		proxyOpts = append(proxyOpts, client.WithClientCertificate(cert))
+	}
+
+	return proxyOpts, nil
+}
+
+// loadHeaderRules loads header rules from the Add, Set and Remove keys with prefix
+func loadHeaderRules(prefix string) (client.HeaderRules, error) {
+	rules := client.NewHeaderRules()
+
+	for _, header := range viper.GetStringSlice(prefix + "Add") {
+		name, value, err := client.ParseHeader(header)
+
+		if err != nil {
+			return rules, err
+		}
+
+		rules.Add.Add(name, value)
+	}
+
+	for _, header := range viper.GetStringSlice(prefix + "Set") {
+		name, value, err := client.ParseHeader(header)
+
+		if err != nil {
+			return rules, err
+		}
+
+		rules.Set.Add(name, value)
+	}
+
+	rules.Remove = viper.GetStringSlice(prefix + "Remove")
+
+	return rules, nil
+}
+
 var clientCmd = &cobra.Command{
 	Use:   "client",
 	Short: "Start the gogrok client",
@@ -68,27 +239,86 @@ var clientCmd = &cobra.Command{
 	PreRun: clientPreRun,
 	Run: func(cmd *cobra.Command, args []string) {
 		setValueFromFlag(cmd.Flags(), "host", "gogrok.clientHost", false)
+		setValueFromFlag(cmd.Flags(), "request-header-add", "gogrok.requestHeaderAdd", false)
+		setValueFromFlag(cmd.Flags(), "request-header-set", "gogrok.requestHeaderSet", false)
+		setValueFromFlag(cmd.Flags(), "request-header-remove", "gogrok.requestHeaderRemove", false)
+		setValueFromFlag(cmd.Flags(), "response-header-add", "gogrok.responseHeaderAdd", false)
+		setValueFromFlag(cmd.Flags(), "response-header-set", "gogrok.responseHeaderSet", false)
+		setValueFromFlag(cmd.Flags(), "response-header-remove", "gogrok.responseHeaderRemove", false)
+		setValueFromFlag(cmd.Flags(), "preserve-host", "gogrok.preserveHost", false)
+		setValueFromFlag(cmd.Flags(), "rewrite-location", "gogrok.rewriteLocation", false)
+		setValueFromFlag(cmd.Flags(), "rewrite-cookies", "gogrok.rewriteCookies", false)
+		setValueFromFlag(cmd.Flags(), "file-listing", "gogrok.fileListing", false)
+		setValueFromFlag(cmd.Flags(), "spa", "gogrok.spaFallback", false)
+		setValueFromFlag(cmd.Flags(), "proxy-protocol", "gogrok.proxyProtocolVersion", false)
+		setValueFromFlag(cmd.Flags(), "tls-verify", "gogrok.tlsVerify", false)
+		setValueFromFlag(cmd.Flags(), "tls-ca", "gogrok.tlsCA", false)
+		setValueFromFlag(cmd.Flags(), "tls-server-name", "gogrok.tlsServerName", false)
+		setValueFromFlag(cmd.Flags(), "tls-cert", "gogrok.tlsCert", false)
+		setValueFromFlag(cmd.Flags(), "tls-key", "gogrok.tlsKey", false)
+		setValueFromFlag(cmd.Flags(), "pool", "gogrok.pool", false)
+		setValueFromFlag(cmd.Flags(), "pool-cookie", "gogrok.poolCookie", false)
+		setValueFromFlag(cmd.Flags(), "health-check", "gogrok.healthCheck", false)
+		setValueFromFlag(cmd.Flags(), "health-interval", "gogrok.healthInterval", false)
+		setValueFromFlag(cmd.Flags(), "compression", "gogrok.compression", false)
+		setValueFromFlag(cmd.Flags(), "dashboard", "gogrok.dashboard", false)
+		setValueFromFlag(cmd.Flags(), "trace-exporter", "gogrok.traceExporter", false)
+		setValueFromFlag(cmd.Flags(), "trace-endpoint", "gogrok.traceEndpoint", false)
 
-		c := client.New(viper.GetString("gogrok.server"), loadClientKey())
+		shutdownTracing, err := setupTracing("gogrok-client")
 
-		host, err := c.Start(args[0], viper.GetString("gogrok.clientHost"))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to set up tracing: "+err.Error())
+			os.Exit(1)
+		}
+
+		defer shutdownTracing()
+
+		proxyOpts, err := loadProxyOptions()
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid proxy options: "+err.Error())
+			os.Exit(1)
+		}
+
+		var dash *dashboard
+
+		if viper.GetBool("gogrok.dashboard") {
+			dash = newDashboard(os.Stdout, viper.GetString("gogrok.server"), args[0])
+
+			proxyOpts = append(proxyOpts, client.WithRequestObserver(dash.observe))
+		}
+
+		c := client.New(viper.GetString("gogrok.server"), loadClientKey(),
+			client.WithPool(viper.GetString("gogrok.pool")),
+			client.WithPoolCookie(viper.GetString("gogrok.poolCookie")),
+			client.WithHealthCheck(viper.GetString("gogrok.healthCheck"), viper.GetDuration("gogrok.healthInterval")),
+			client.WithCompression(viper.GetStringSlice("gogrok.compression")...))
+
+		host, err := c.Start(args[0], viper.GetString("gogrok.clientHost"), proxyOpts...)
 
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "Unable to start server: "+err.Error())
 			os.Exit(1)
 		}
 
-		cmd.Println("Successfully bound host and started proxy")
 		log.WithField("host", host).Info("Successfully bound host and started proxy")
 
+		sig := make(chan os.Signal, 1)
+
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL)
+
+		if dash != nil {
+			dash.run(c, host, sig)
+			return
+		}
+
+		cmd.Println("Successfully bound host and started proxy")
+
 		cmd.Println("Endpoints:")
 		cmd.Printf("http://%s\n", host)
 		cmd.Printf("https://%s\n", host)
 
-		sig := make(chan os.Signal)
-
-		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT, syscall.SIGKILL)
-
 		<-sig
 	},
 }
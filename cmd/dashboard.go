@@ -0,0 +1,336 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gogrok.ccatss.dev/client"
+	"golang.org/x/term"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// dashboardMaxRequests is the number of requests kept for display
+	dashboardMaxRequests = 500
+
+	// dashboardHeaderLines is the number of lines above the request list
+	dashboardHeaderLines = 12
+
+	pingInterval = 5 * time.Second
+)
+
+// ANSI escape sequences used by the dashboard
+const (
+	ansiAltScreen     = "\x1b[?1049h"
+	ansiMainScreen    = "\x1b[?1049l"
+	ansiHideCursor    = "\x1b[?25l"
+	ansiShowCursor    = "\x1b[?25h"
+	ansiHome          = "\x1b[H"
+	ansiClearLine     = "\x1b[K"
+	ansiClearToScreen = "\x1b[J"
+	ansiBold          = "\x1b[1m"
+	ansiRed           = "\x1b[31m"
+	ansiGreen         = "\x1b[32m"
+	ansiYellow        = "\x1b[33m"
+	ansiCyan          = "\x1b[36m"
+	ansiReset         = "\x1b[0m"
+)
+
+// dashboard displays the session status and requests passing through the client.
+// When out isn't a terminal, each request is printed as a line instead.
+type dashboard struct {
+	out *os.File
+	tty bool
+
+	server  string
+	backend string
+	urls    []string
+
+	online   bool
+	latency  time.Duration
+	requests []client.RequestEvent
+	total    int
+	dirty    bool
+
+	sync.Mutex
+}
+
+// newDashboard creates a dashboard for the tunnel between server and backend
+func newDashboard(out *os.File, server, backend string) *dashboard {
+	return &dashboard{
+		out:     out,
+		tty:     term.IsTerminal(int(out.Fd())),
+		server:  server,
+		backend: backend,
+		online:  true,
+	}
+}
+
+// observe records a completed request, and is used as the proxy's client.RequestObserver
+func (d *dashboard) observe(event client.RequestEvent) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.total++
+
+	if !d.tty {
+		fmt.Fprintln(d.out, formatRequest(event, false))
+		return
+	}
+
+	d.requests = append(d.requests, event)
+
+	if len(d.requests) > dashboardMaxRequests {
+		d.requests = d.requests[len(d.requests)-dashboardMaxRequests:]
+	}
+
+	d.dirty = true
+}
+
+// run displays the dashboard for host until stop receives a signal
+func (d *dashboard) run(c *client.Client, host string, stop <-chan os.Signal) {
+	d.Lock()
+	d.urls = []string{"http://" + host, "https://" + host}
+	d.Unlock()
+
+	closed := make(chan struct{})
+
+	go func() {
+		c.Wait()
+		close(closed)
+	}()
+
+	if !d.tty {
+		for _, u := range d.urls {
+			fmt.Fprintf(d.out, "Forwarding %s -> %s\n", u, d.backend)
+		}
+
+		select {
+		case <-stop:
+		case <-closed:
+			fmt.Fprintln(d.out, "Session closed")
+		}
+
+		return
+	}
+
+	// Logs would be drawn over the dashboard
+	logOutput := log.StandardLogger().Out
+	log.SetOutput(io.Discard)
+
+	io.WriteString(d.out, ansiAltScreen+ansiHideCursor)
+
+	defer func() {
+		io.WriteString(d.out, ansiShowCursor+ansiMainScreen)
+		log.SetOutput(logOutput)
+	}()
+
+	go d.measureLatency(c, closed)
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	d.render()
+
+	lastRender := time.Now()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-closed:
+			d.Lock()
+			d.online = false
+			d.dirty = true
+			d.Unlock()
+
+			// Keep the last state on screen until the user quits
+			closed = nil
+		case <-ticker.C:
+		}
+
+		d.Lock()
+		dirty := d.dirty
+		d.Unlock()
+
+		// Redraw regularly to follow terminal resizes
+		if dirty || time.Since(lastRender) > time.Second {
+			d.render()
+			lastRender = time.Now()
+		}
+	}
+}
+
+// measureLatency pings the server until closed is closed
+func (d *dashboard) measureLatency(c *client.Client, closed <-chan struct{}) {
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+
+	for {
+		if latency, err := c.Ping(); err == nil {
+			d.Lock()
+			d.latency = latency
+			d.dirty = true
+			d.Unlock()
+		}
+
+		select {
+		case <-closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// render draws the dashboard, overwriting the previous frame in place
+func (d *dashboard) render() {
+	width, height, err := term.GetSize(int(d.out.Fd()))
+
+	if err != nil {
+		width, height = 80, 24
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	d.dirty = false
+
+	var buf bytes.Buffer
+
+	line := func(s string) {
+		buf.WriteString(truncate(s, width) + ansiReset + ansiClearLine + "\n")
+	}
+
+	field := func(name, value string) {
+		line(fmt.Sprintf("%-20s%s", name, value))
+	}
+
+	buf.WriteString(ansiHome)
+
+	padding := width - len("gogrok") - len("(Ctrl+C to quit)")
+
+	if padding < 1 {
+		padding = 1
+	}
+
+	line(ansiBold + "gogrok" + ansiReset + strings.Repeat(" ", padding) + "(Ctrl+C to quit)")
+	line("")
+
+	if d.online {
+		field("Session Status", ansiGreen+"online")
+	} else {
+		field("Session Status", ansiRed+"offline")
+	}
+
+	field("Server", d.server)
+
+	if d.latency > 0 {
+		field("Latency", formatDuration(d.latency))
+	} else {
+		field("Latency", "-")
+	}
+
+	for i, u := range d.urls {
+		name := ""
+
+		if i == 0 {
+			name = "Forwarding"
+		}
+
+		field(name, u+" -> "+d.backend)
+	}
+
+	field("Requests", strconv.Itoa(d.total))
+	line("")
+	line(ansiBold + "HTTP Requests")
+	line("-------------")
+
+	rows := height - dashboardHeaderLines - (len(d.urls) - 2)
+
+	for i := len(d.requests) - 1; i >= 0 && rows > 0; i-- {
+		line(formatRequest(d.requests[i], true))
+		rows--
+	}
+
+	buf.WriteString(ansiClearToScreen)
+
+	d.out.Write(buf.Bytes())
+}
+
+// formatRequest formats a request as a line, with colored statuses on terminals
+func formatRequest(event client.RequestEvent, color bool) string {
+	status := strconv.Itoa(event.Status)
+
+	if event.Status == 0 {
+		status = "ERR"
+	}
+
+	if color {
+		status = statusColor(event.Status) + status + ansiReset
+	}
+
+	line := fmt.Sprintf("%s  %-7s %-40s %s %8s", event.Start.Format("15:04:05"), event.Method, event.Path, status, formatDuration(event.Duration))
+
+	if event.Err != nil {
+		line += "  " + event.Err.Error()
+	}
+
+	return line
+}
+
+// statusColor returns the color of a response status
+func statusColor(status int) string {
+	switch {
+	case status == 0 || status >= 500:
+		return ansiRed
+	case status >= 400:
+		return ansiYellow
+	case status >= 300:
+		return ansiCyan
+	default:
+		return ansiGreen
+	}
+}
+
+// formatDuration rounds a duration for display
+func formatDuration(d time.Duration) string {
+	if d < 10*time.Millisecond {
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64) + "ms"
+	}
+
+	if d < time.Second {
+		return strconv.FormatInt(d.Milliseconds(), 10) + "ms"
+	}
+
+	return strconv.FormatFloat(d.Seconds(), 'f', 2, 64) + "s"
+}
+
+// truncate shortens s to width visible characters, ignoring escape sequences
+func truncate(s string, width int) string {
+	visible := 0
+	escape := false
+
+	for i, r := range s {
+		switch {
+		case escape:
+			if r >= '@' && r <= '~' && r != '[' {
+				escape = false
+			}
+		case r == '\x1b':
+			escape = true
+		default:
+			visible++
+
+			if visible > width {
+				return s[:i]
+			}
+		}
+	}
+
+	return s
+}
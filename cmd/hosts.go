@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gogrok.ccatss.dev/client"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+func init() {
+	hostsCmd.Flags().String("server", "localhost:2222", "Gogrok Server Address")
+	hostsCmd.Flags().Bool("json", false, "Output hosts as JSON")
+	rootCmd.AddCommand(hostsCmd)
+}
+
+var hostsCmd = &cobra.Command{
+	Use:    "hosts",
+	Short:  "List the hosts registered to your key",
+	PreRun: clientPreRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := client.New(viper.GetString("gogrok.server"), loadClientKey())
+
+		hosts, err := c.ListHosts()
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to list hosts: "+err.Error())
+			os.Exit(1)
+		}
+
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			enc := json.NewEncoder(cmd.OutOrStdout())
+			enc.SetIndent("", "  ")
+			enc.Encode(hosts)
+			return
+		}
+
+		if len(hosts) == 0 {
+			cmd.Println("No hosts registered")
+			return
+		}
+
+		w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 2, ' ', 0)
+
+		fmt.Fprintln(w, "HOST\tROLE\tSTATUS\tCREATED\tLAST USE")
+
+		for _, host := range hosts {
+			status := "offline"
+
+			if host.Online {
+				status = "online"
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", host.Host, host.Role, status, formatTime(host.Created), formatTime(host.LastUse))
+		}
+
+		w.Flush()
+	},
+}
+
+// formatTime formats a time in the local timezone, where the zero time is unknown
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.Local().Format("2006-01-02 15:04")
+}
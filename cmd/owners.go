@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gogrok.ccatss.dev/client"
+	"golang.org/x/crypto/ssh"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var (
+	ErrNoHostOrKey = errors.New("host and public key must be specified")
+)
+
+func init() {
+	ownersCmd.PersistentFlags().String("server", "localhost:2222", "Gogrok Server Address")
+	ownersCmd.AddCommand(ownersAddCmd, ownersRemoveCmd)
+	rootCmd.AddCommand(ownersCmd)
+}
+
+// hostAndKeyArgs validates commands taking a host and a public key
+func hostAndKeyArgs(cmd *cobra.Command, args []string) error {
+	if len(args) < 2 {
+		return ErrNoHostOrKey
+	}
+	return nil
+}
+
+// readPublicKeyArg reads a public key from a file path or an authorized keys formatted string
+func readPublicKeyArg(arg string) (string, error) {
+	data := []byte(arg)
+
+	if _, err := os.Stat(arg); err == nil {
+		if data, err = ioutil.ReadFile(arg); err != nil {
+			return "", err
+		}
+	}
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey(data)
+
+	if err != nil {
+		return "", fmt.Errorf("invalid public key: %w", err)
+	}
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key))), nil
+}
+
+var ownersCmd = &cobra.Command{
+	Use:   "owners",
+	Short: "Manage co-owners of a registered host",
+}
+
+var ownersAddCmd = &cobra.Command{
+	Use:    "add <host> <public key or file>",
+	Short:  "Add a co-owner to a registered host",
+	Args:   hostAndKeyArgs,
+	PreRun: clientPreRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		key, err := readPublicKeyArg(args[1])
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+
+		c := client.New(viper.GetString("gogrok.server"), loadClientKey())
+
+		if err := c.AddOwner(args[0], key); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to add owner: "+err.Error())
+			os.Exit(1)
+		}
+
+		cmd.Println("Successfully added co-owner to host " + args[0])
+	},
+}
+
+var ownersRemoveCmd = &cobra.Command{
+	Use:    "remove <host> <public key or file>",
+	Short:  "Remove a co-owner from a registered host",
+	Args:   hostAndKeyArgs,
+	PreRun: clientPreRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		key, err := readPublicKeyArg(args[1])
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+
+		c := client.New(viper.GetString("gogrok.server"), loadClientKey())
+
+		if err := c.RemoveOwner(args[0], key); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to remove owner: "+err.Error())
+			os.Exit(1)
+		}
+
+		cmd.Println("Successfully removed co-owner from host " + args[0])
+	},
+}
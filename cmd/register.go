@@ -34,6 +34,17 @@ var registerCmd = &cobra.Command{
 
 		err := c.Register(args[0])
 
+		var verifyErr *client.VerificationRequiredError
+
+		if errors.As(err, &verifyErr) {
+			cmd.Println("Host " + verifyErr.Host + " must be verified before it can be registered.")
+			cmd.Println("Create a DNS TXT record with the following name and value, then run this command again:")
+			cmd.Println()
+			cmd.Println("  Name:  " + verifyErr.Record)
+			cmd.Println("  Value: " + verifyErr.Token)
+			os.Exit(1)
+		}
+
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "Unable to register: "+err.Error())
 			os.Exit(1)
@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"github.com/spf13/viper"
+	"gogrok.ccatss.dev/server"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// reloadDelay groups the multiple file events caused by a single save
+const reloadDelay = 250 * time.Millisecond
+
+// reloader reloads authorized keys, policy, admin keys and handler configuration without restarting the server.
+// Viper isn't safe for concurrent use, so the config file is only read and used by the goroutine running watchReload.
+type reloader struct {
+	fs      afero.Fs
+	server  *server.Server
+	handler *server.ForwardedHTTPHandler
+	watcher *fsnotify.Watcher
+	watched map[string]bool
+	trigger chan struct{}
+
+	// configFile is the config file in use, if any, and readConfig is set when it should be read before reloading
+	configFile string
+	readConfig bool
+
+	sync.RWMutex
+}
+
+// watchReload reloads on SIGHUP, config file changes and authorized keys or policy file changes
+func watchReload(r *reloader) {
+	r.trigger = make(chan struct{}, 1)
+	r.watched = make(map[string]bool)
+	r.configFile = viper.ConfigFileUsed()
+
+	watcher, err := fsnotify.NewWatcher()
+
+	if err != nil {
+		log.WithError(err).Warning("Unable to watch config, authorized keys and policy files, reload using SIGHUP")
+	} else {
+		r.watcher = watcher
+		r.watchFiles()
+
+		go r.handleEvents()
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGHUP)
+
+		for range sig {
+			log.Info("Received SIGHUP")
+
+			r.requestReload(true)
+		}
+	}()
+
+	for range r.trigger {
+		time.Sleep(reloadDelay)
+
+		select {
+		case <-r.trigger:
+		default:
+		}
+
+		r.Lock()
+		readConfig := r.readConfig
+		r.readConfig = false
+		r.Unlock()
+
+		if readConfig && r.configFile != "" {
+			if err := viper.ReadInConfig(); err != nil {
+				log.WithError(err).Warning("Unable to read config file")
+			}
+		}
+
+		r.reload()
+	}
+}
+
+// requestReload queues a reload, coalescing multiple requests.
+// When readConfig is set, the config file is read again before reloading.
+func (r *reloader) requestReload(readConfig bool) {
+	if readConfig {
+		r.Lock()
+		r.readConfig = true
+		r.Unlock()
+	}
+
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// watchFiles watches the directories of the config, authorized keys and policy files, as editors often replace files
+func (r *reloader) watchFiles() {
+	if r.watcher == nil {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	files := []string{r.configFile, viper.GetString("gogrok.authorizedKeyFile"), viper.GetString("gogrok.policyFile"), viper.GetString("gogrok.adminKeyFile")}
+
+	for _, file := range files {
+		if file == "" || r.watched[filepath.Clean(file)] {
+			continue
+		}
+
+		if err := r.watcher.Add(filepath.Dir(file)); err != nil {
+			log.WithError(err).WithField("file", file).Warning("Unable to watch file for changes")
+			continue
+		}
+
+		r.watched[filepath.Clean(file)] = true
+	}
+}
+
+func (r *reloader) handleEvents() {
+	for {
+		select {
+		case event, ok := <-r.watcher.Events:
+			if !ok {
+				return
+			}
+
+			name := filepath.Clean(event.Name)
+
+			r.RLock()
+			watched := r.watched[name]
+			r.RUnlock()
+
+			if watched && event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				r.requestReload(r.configFile != "" && name == filepath.Clean(r.configFile))
+			}
+		case err, ok := <-r.watcher.Errors:
+			if !ok {
+				return
+			}
+
+			log.WithError(err).Warning("File watcher error")
+		}
+	}
+}
+
+// reload reloads authorized keys, policy, admin keys and handler options.
+// Each keeps its previous configuration when it fails to load, without affecting the others.
+// Removing the authorized keys or policy file from the configuration requires a restart.
+// Existing connections and tunnels are unaffected.
+func (r *reloader) reload() {
+	r.watchFiles()
+
+	if keysFile := viper.GetString("gogrok.authorizedKeyFile"); keysFile != "" {
+		authorizedKeys, err := loadAuthorizedKeys(r.fs, keysFile)
+
+		if err != nil {
+			log.WithError(err).Warning("Unable to reload authorized keys file")
+		} else {
+			r.server.SetAuthorizedKeyEntries(authorizedKeys)
+
+			log.WithField("keys", len(authorizedKeys)).Info("Reloaded authorized keys")
+		}
+	}
+
+	if policyFile := viper.GetString("gogrok.policyFile"); policyFile != "" {
+		policy, err := loadPolicy(r.fs, policyFile)
+
+		if err != nil {
+			log.WithError(err).Warning("Unable to reload policy file")
+		} else {
+			r.server.SetPolicy(policy)
+
+			log.Info("Reloaded policy")
+		}
+	}
+
+	if adminKeysFile := viper.GetString("gogrok.adminKeyFile"); adminKeysFile != "" {
+		adminKeys, err := loadAdminKeys(r.fs, adminKeysFile)
+
+		if err != nil {
+			log.WithError(err).Warning("Unable to reload admin keys file")
+		} else {
+			r.server.SetAdminKeys(adminKeys)
+
+			log.WithField("keys", len(adminKeys)).Info("Reloaded admin keys")
+		}
+	}
+
+	handlerOpts, err := loadHandlerOptions()
+
+	if err != nil {
+		log.WithError(err).Warning("Unable to reload configuration")
+		return
+	}
+
+	r.handler.Configure(handlerOpts...)
+
+	log.Info("Reloaded configuration")
+}
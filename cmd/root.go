@@ -34,6 +34,8 @@ func init() {
 	rootCmd.PersistentFlags().String("passphrase", "", "Server/Client key passphrase")
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.gogrok.yaml)")
 	rootCmd.PersistentFlags().Bool("viper", true, "use Viper for configuration")
+	rootCmd.PersistentFlags().String("trace-exporter", "", "OpenTelemetry trace exporter (stdout, file or otlp)")
+	rootCmd.PersistentFlags().String("trace-endpoint", "", "Trace file for the file exporter, or OTLP/HTTP endpoint url")
 	viper.BindPFlag("useViper", rootCmd.PersistentFlags().Lookup("viper"))
 }
 
@@ -59,11 +61,15 @@ func initConfig() {
 	// Generic binds
 	viper.BindEnv("gogrok.storageDir", "GOGROK_STORAGE_DIR")
 
+	viper.BindEnv("gogrok.traceExporter", "GOGROK_TRACE_EXPORTER")
+	viper.BindEnv("gogrok.traceEndpoint", "GOGROK_TRACE_ENDPOINT")
+
 	// Server binds
 	viper.BindEnv("gogrok.sshAddress", "GOGROK_SSH_ADDRESS")
 	viper.BindEnv("gogrok.httpAddress", "GOGROK_HTTP_ADDRESS")
 	viper.BindEnv("gogrok.authorizedKeyFile", "GOGROK_AUTHORIZED_KEY_FILE")
 	viper.BindEnv("gogrok.domains", "GOGROK_DOMAINS")
+	viper.BindEnv("gogrok.clusterSecret", "GOGROK_CLUSTER_SECRET")
 
 	// Client binds
 	viper.BindEnv("gogrok.clientKey", "GOGROK_CLIENT_KEY")
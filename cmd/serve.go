@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/gliderlabs/ssh"
 	log "github.com/sirupsen/logrus"
@@ -13,17 +14,43 @@ import (
 	"gogrok.ccatss.dev/server"
 	"gogrok.ccatss.dev/server/store"
 	gossh "golang.org/x/crypto/ssh"
-	"math/rand"
+	"os"
+	"os/signal"
 	"path"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func init() {
 	serveCmd.Flags().String("bind", ":2222", "SSH Server Bind Address")
 	serveCmd.Flags().String("http", ":8080", "HTTP Server Bind Address")
 	serveCmd.Flags().String("keys", "", "Authorized keys file to control access")
+	serveCmd.Flags().String("policy", "", "Policy file controlling what each key may do")
+	serveCmd.Flags().String("admin-keys", "", "Authorized keys file of keys allowed to use admin commands over ssh")
 	serveCmd.Flags().StringSlice("domains", nil, "Domains to use for ")
 	serveCmd.Flags().String("store", "", "Store file to use when allowing host registration")
+	serveCmd.Flags().String("daily-quota", "", "Default daily bandwidth quota per key (e.g. 5GB)")
+	serveCmd.Flags().String("monthly-quota", "", "Default monthly bandwidth quota per key (e.g. 100GB)")
+	serveCmd.Flags().Duration("host-ttl", 0, "Expire registered hosts unused for this duration (e.g. 720h)")
+	serveCmd.Flags().Duration("host-ttl-warning", 7*24*time.Hour, "Warn owners this long before a host expires")
+	serveCmd.Flags().StringSlice("pinned-hosts", nil, "Registered hosts which never expire")
+	serveCmd.Flags().Bool("verify-domains", false, "Allow registration of custom domains verified using DNS TXT records")
+	serveCmd.Flags().String("dns-resolver", "", "DNS server (host:port) used for domain verification, defaults to the system resolver")
+	serveCmd.Flags().String("cluster-bind", "", "Internal cluster link bind address, enables cluster mode")
+	serveCmd.Flags().String("cluster-address", "", "Internal cluster link address advertised to peers (e.g. http://10.0.0.1:9000)")
+	serveCmd.Flags().StringSlice("cluster-peers", nil, "Internal cluster link addresses of other nodes")
+	serveCmd.Flags().String("cluster-secret", "", "Shared secret used to authenticate cluster nodes")
+	serveCmd.Flags().String("templates", "", "Directory of templates overriding the built in error and landing pages")
+	serveCmd.Flags().Bool("landing-page", false, "Serve a landing page on the bare domains")
+	serveCmd.Flags().StringSlice("proxy-protocol", nil, "Listeners (http, ssh) requiring a PROXY protocol header, when behind an L4 load balancer")
+	serveCmd.Flags().StringSlice("trusted-proxies", nil, "Proxy addresses or CIDR ranges whose forwarding headers are trusted")
+	serveCmd.Flags().StringSlice("tunnel-compression", common.SupportedCompression(), "Compression algorithms clients may use for tunneled traffic, or none")
+	serveCmd.Flags().Bool("gzip", false, "Gzip text responses for visitors accepting gzip")
+	serveCmd.Flags().String("host-template", server.DefaultHostTemplate, "Template for random hosts (e.g. {{adjective}}-{{animal}}-{{hex 4}})")
+	serveCmd.Flags().StringSlice("word-lists", nil, "Word list files available in host templates, as name=file (e.g. color=colors.txt for {{color}})")
+	serveCmd.Flags().Bool("key-hosts", false, "Derive random hosts from the client's public key, so each key keeps the same host")
 	rootCmd.AddCommand(serveCmd)
 }
 
@@ -35,12 +62,46 @@ var serveCmd = &cobra.Command{
 
 		viper.SetDefault("gogrok.httpAddress", ":8080")
 		viper.SetDefault("gogrok.sshAddress", ":2222")
+		viper.SetDefault("gogrok.hostTTLWarning", 7*24*time.Hour)
+		viper.SetDefault("gogrok.tunnelCompression", common.SupportedCompression())
 
 		setValueFromFlag(cmd.Flags(), "bind", "gogrok.sshAddress", false)
 		setValueFromFlag(cmd.Flags(), "http", "gogrok.httpAddress", false)
 		setValueFromFlag(cmd.Flags(), "keys", "gogrok.authorizedKeyFile", false)
+		setValueFromFlag(cmd.Flags(), "policy", "gogrok.policyFile", false)
+		setValueFromFlag(cmd.Flags(), "admin-keys", "gogrok.adminKeyFile", false)
 		setValueFromFlag(cmd.Flags(), "domains", "gogrok.domains", false)
 		setValueFromFlag(cmd.Flags(), "store", "gogrok.store", false)
+		setValueFromFlag(cmd.Flags(), "daily-quota", "gogrok.dailyQuota", false)
+		setValueFromFlag(cmd.Flags(), "monthly-quota", "gogrok.monthlyQuota", false)
+		setValueFromFlag(cmd.Flags(), "host-ttl", "gogrok.hostTTL", false)
+		setValueFromFlag(cmd.Flags(), "host-ttl-warning", "gogrok.hostTTLWarning", false)
+		setValueFromFlag(cmd.Flags(), "pinned-hosts", "gogrok.pinnedHosts", false)
+		setValueFromFlag(cmd.Flags(), "verify-domains", "gogrok.verifyDomains", false)
+		setValueFromFlag(cmd.Flags(), "dns-resolver", "gogrok.dnsResolver", false)
+		setValueFromFlag(cmd.Flags(), "cluster-bind", "gogrok.clusterBind", false)
+		setValueFromFlag(cmd.Flags(), "cluster-address", "gogrok.clusterAddress", false)
+		setValueFromFlag(cmd.Flags(), "cluster-peers", "gogrok.clusterPeers", false)
+		setValueFromFlag(cmd.Flags(), "cluster-secret", "gogrok.clusterSecret", false)
+		setValueFromFlag(cmd.Flags(), "templates", "gogrok.templateDir", false)
+		setValueFromFlag(cmd.Flags(), "landing-page", "gogrok.landingPage", false)
+		setValueFromFlag(cmd.Flags(), "trusted-proxies", "gogrok.trustedProxies", false)
+		setValueFromFlag(cmd.Flags(), "proxy-protocol", "gogrok.proxyProtocol", false)
+		setValueFromFlag(cmd.Flags(), "tunnel-compression", "gogrok.tunnelCompression", false)
+		setValueFromFlag(cmd.Flags(), "gzip", "gogrok.edgeCompression", false)
+		setValueFromFlag(cmd.Flags(), "host-template", "gogrok.hostTemplate", false)
+		setValueFromFlag(cmd.Flags(), "word-lists", "gogrok.wordLists", false)
+		setValueFromFlag(cmd.Flags(), "key-hosts", "gogrok.keyHosts", false)
+		setValueFromFlag(cmd.Flags(), "trace-exporter", "gogrok.traceExporter", false)
+		setValueFromFlag(cmd.Flags(), "trace-endpoint", "gogrok.traceEndpoint", false)
+
+		shutdownTracing, err := setupTracing("gogrok-server")
+
+		if err != nil {
+			log.WithError(err).Fatalln("Unable to set up tracing")
+		}
+
+		defer shutdownTracing()
 
 		key, err := common.LoadOrGenerateKey(baseFs, path.Join(viper.GetString("gogrok.storageDir"), "server.key"), "")
 
@@ -64,6 +125,19 @@ var serveCmd = &cobra.Command{
 			opts = append(opts, server.WithSSHAddress(sshServerBind))
 		}
 
+		for _, listener := range viper.GetStringSlice("gogrok.proxyProtocol") {
+			switch listener {
+			case "ssh":
+				opts = append(opts, server.WithSSHProxyProtocol())
+			case "http":
+				opts = append(opts, server.WithHTTPProxyProtocol())
+			default:
+				log.WithField("listener", listener).Fatalln("Unknown PROXY protocol listener, expected http or ssh")
+			}
+
+			log.WithField("listener", listener).Info("Requiring PROXY protocol headers")
+		}
+
 		if authorizedKeysFile := viper.GetString("gogrok.authorizedKeyFile"); authorizedKeysFile != "" {
 			authorizedKeys, err := loadAuthorizedKeys(baseFs, authorizedKeysFile)
 
@@ -72,25 +146,46 @@ var serveCmd = &cobra.Command{
 				return
 			}
 
-			opts = append(opts, server.WithAuthorizedKeys(authorizedKeys))
+			opts = append(opts, server.WithAuthorizedKeyEntries(authorizedKeys))
 
 			log.WithField("keyFile", authorizedKeysFile).Info("Authorizing public keys on connection")
 		}
 
-		handlerOpts := make([]server.HandlerOption, 0)
+		if policyFile := viper.GetString("gogrok.policyFile"); policyFile != "" {
+			policy, err := loadPolicy(baseFs, policyFile)
+
+			if err != nil {
+				log.WithError(err).Fatalln("Unable to load policy file")
+				return
+			}
+
+			opts = append(opts, server.WithPolicy(policy))
+
+			log.WithField("policyFile", policyFile).Info("Applying key policy")
+		}
+
+		if adminKeysFile := viper.GetString("gogrok.adminKeyFile"); adminKeysFile != "" {
+			adminKeys, err := loadAdminKeys(baseFs, adminKeysFile)
 
-		if domains := viper.GetStringSlice("gogrok.domains"); domains != nil {
-			generator := func() string {
-				return server.RandomAnimal() + "." + domains[rand.Intn(len(domains))]
+			if err != nil {
+				log.WithError(err).Fatalln("Unable to load admin keys file")
+				return
 			}
 
-			validator := server.ValidateMulti(server.DenyPrefixIn(server.Animals()), server.SuffixIn(domains))
+			opts = append(opts, server.WithAdminKeys(adminKeys))
+
+			log.WithField("keyFile", adminKeysFile).Info("Enabling admin commands for keys")
+		}
 
-			handlerOpts = append(handlerOpts, server.WithProvider(generator), server.WithValidator(validator))
+		handlerOpts, err := loadHandlerOptions()
 
-			log.WithField("domains", domains).Info("Registered domains for random use")
+		if err != nil {
+			log.WithError(err).Fatalln("Unable to load configuration")
+			return
 		}
 
+		var reapInterval time.Duration
+
 		if storeUri := viper.GetString("gogrok.store"); storeUri != "" {
 			driver := "bolt"
 
@@ -117,14 +212,54 @@ var serveCmd = &cobra.Command{
 			log.WithField("driver", driver).Info("Host store set, registration enabled")
 
 			handlerOpts = append(handlerOpts, server.WithStore(s))
+
+			if hostTTL := viper.GetDuration("gogrok.hostTTL"); hostTTL > 0 {
+				handlerOpts = append(handlerOpts, server.WithHostExpiry(hostTTL, viper.GetDuration("gogrok.hostTTLWarning")))
+
+				reapInterval = time.Hour
+
+				if hostTTL < 10*time.Hour {
+					reapInterval = hostTTL / 10
+				}
+
+				log.WithField("ttl", hostTTL).Info("Unused hosts will expire")
+			}
+
+			if viper.GetBool("gogrok.verifyDomains") {
+				resolver := viper.GetString("gogrok.dnsResolver")
+
+				handlerOpts = append(handlerOpts, server.WithDomainVerification(server.NewTXTResolver(resolver)))
+
+				log.WithField("resolver", resolver).Info("Custom domain registration enabled")
+			}
+		}
+
+		var cluster *server.Cluster
+
+		if clusterBind := viper.GetString("gogrok.clusterBind"); clusterBind != "" {
+			cluster, err = server.NewCluster(viper.GetString("gogrok.clusterAddress"), viper.GetString("gogrok.clusterSecret"),
+				server.WithPeers(viper.GetStringSlice("gogrok.clusterPeers")))
+
+			if err != nil {
+				log.WithError(err).Fatalln("Unable to configure cluster")
+				return
+			}
+
+			handlerOpts = append(handlerOpts, server.WithCluster(cluster))
+
+			log.WithField("peers", viper.GetStringSlice("gogrok.clusterPeers")).Info("Cluster mode enabled")
 		}
 
-		if len(handlerOpts) > 0 {
-			handler := server.NewHttpHandler(handlerOpts...)
+		handler := server.NewHttpHandler(handlerOpts...)
+
+		opts = append(opts, server.WithForwardHandler("http", handler))
 
-			opts = append(opts, server.WithForwardHandler("http", handler))
+		if reapInterval > 0 {
+			go handler.RunReaper(context.Background(), reapInterval)
 		}
 
+		go handler.RunUsageFlusher(context.Background(), server.DefaultUsageFlushInterval)
+
 		s, err := server.New(opts...)
 
 		if err != nil {
@@ -132,6 +267,7 @@ var serveCmd = &cobra.Command{
 		}
 
 		httpServerBind := viper.GetString("gogrok.httpAddress")
+		clusterBind := viper.GetString("gogrok.clusterBind")
 
 		log.WithFields(log.Fields{
 			"sshAddress":  sshServerBind,
@@ -148,16 +284,180 @@ var serveCmd = &cobra.Command{
 			ch <- s.StartHTTP(httpServerBind)
 		}()
 
-		err = <-ch
+		if cluster != nil {
+			go func() {
+				ch <- cluster.Start(clusterBind)
+			}()
+		}
+
+		// Viper is only used by the reloader from here on, as it isn't safe for concurrent use
+		go watchReload(&reloader{
+			fs:      baseFs,
+			server:  s,
+			handler: handler,
+		})
+
+		sig := make(chan os.Signal, 1)
+
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+
+		select {
+		case err = <-ch:
+		case <-sig:
+			handler.FlushUsage()
+
+			// Return so pending traces are flushed
+			return
+		}
 
 		if err != nil {
+			shutdownTracing()
 			log.WithError(err).Fatalln("Unable to start server due to error")
 		}
 	},
 }
 
-// loadAuthorizedKeys loads an authorized keys file
-func loadAuthorizedKeys(fs afero.Fs, file string) ([]string, error) {
+// loadHandlerOptions builds the handler options which can be reloaded at runtime
+func loadHandlerOptions() ([]server.HandlerOption, error) {
+	handlerOpts := []server.HandlerOption{
+		server.WithProvider(server.RandomAnimal),
+		server.WithValidator(server.DenyAll),
+		server.WithQuotaProvider(server.Unlimited),
+		server.WithPinnedHosts(viper.GetStringSlice("gogrok.pinnedHosts")),
+		server.WithLandingPage(nil),
+	}
+
+	pages, err := server.NewPages(viper.GetString("gogrok.templateDir"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	handlerOpts = append(handlerOpts, server.WithPages(pages))
+
+	trustedProxies, err := server.ParseTrustedProxies(viper.GetStringSlice("gogrok.trustedProxies"))
+
+	if err != nil {
+		return nil, err
+	}
+
+	handlerOpts = append(handlerOpts, server.WithTrustedProxies(trustedProxies))
+
+	compression, err := loadTunnelCompression()
+
+	if err != nil {
+		return nil, err
+	}
+
+	handlerOpts = append(handlerOpts,
+		server.WithTunnelCompression(compression),
+		server.WithEdgeCompression(viper.GetBool("gogrok.edgeCompression")))
+
+	if domains := viper.GetStringSlice("gogrok.domains"); len(domains) > 0 {
+		hostTemplate, err := loadHostTemplate(domains)
+
+		if err != nil {
+			return nil, err
+		}
+
+		provider := server.WithProvider(hostTemplate.Random())
+
+		if viper.GetBool("gogrok.keyHosts") {
+			provider = server.WithKeyedProvider(hostTemplate.Keyed())
+		}
+
+		// Hosts the template can generate are reserved for random use, as are animal prefixes
+		validator := server.ValidateMulti(server.DenyPrefixIn(server.Animals()), hostTemplate.Validator(), server.SuffixIn(domains))
+
+		handlerOpts = append(handlerOpts, provider, server.WithValidator(validator))
+
+		if viper.GetBool("gogrok.landingPage") {
+			handlerOpts = append(handlerOpts, server.WithLandingPage(domains))
+		}
+
+		log.WithField("domains", domains).Info("Registered domains for random use")
+	}
+
+	quotaProvider, err := loadQuotas()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if quotaProvider != nil {
+		handlerOpts = append(handlerOpts, server.WithQuotaProvider(quotaProvider))
+
+		log.Info("Bandwidth quotas enabled")
+	}
+
+	return handlerOpts, nil
+}
+
+// loadTunnelCompression loads the compression algorithms clients may use, where none disables compression
+func loadTunnelCompression() ([]string, error) {
+	var algorithms []string
+
+	for _, algorithm := range viper.GetStringSlice("gogrok.tunnelCompression") {
+		algorithm = strings.ToLower(strings.TrimSpace(algorithm))
+
+		if algorithm == "" || algorithm == "none" {
+			continue
+		}
+
+		if common.NegotiateCompression(algorithm, common.SupportedCompression()) == "" {
+			return nil, fmt.Errorf("%w: %s", common.ErrUnsupportedCompression, algorithm)
+		}
+
+		algorithms = append(algorithms, algorithm)
+	}
+
+	return algorithms, nil
+}
+
+// loadHostTemplate builds the random host template from gogrok.hostTemplate and gogrok.wordLists
+func loadHostTemplate(domains []string) (*server.HostTemplate, error) {
+	words := server.DefaultWordLists()
+
+	for _, entry := range viper.GetStringSlice("gogrok.wordLists") {
+		parts := strings.SplitN(entry, "=", 2)
+
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid word list %s, expected name=file", entry)
+		}
+
+		list, err := loadWordList(parts[1])
+
+		if err != nil {
+			return nil, fmt.Errorf("unable to load word list %s: %w", parts[0], err)
+		}
+
+		words[parts[0]] = list
+	}
+
+	text := viper.GetString("gogrok.hostTemplate")
+
+	if text == "" {
+		text = server.DefaultHostTemplate
+	}
+
+	return server.NewHostTemplate(text, words, domains)
+}
+
+// loadWordList loads a word list file
+func loadWordList(file string) ([]string, error) {
+	f, err := os.Open(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	return server.LoadWordList(f)
+}
+
+// loadAuthorizedKeys loads an authorized keys file, including supported key options
+func loadAuthorizedKeys(fs afero.Fs, file string) ([]*server.AuthorizedKey, error) {
 	f, err := fs.Open(file)
 
 	if err != nil {
@@ -166,24 +466,143 @@ func loadAuthorizedKeys(fs afero.Fs, file string) ([]string, error) {
 
 	defer f.Close()
 
-	keys := make([]string, 0)
+	keys := make([]*server.AuthorizedKey, 0)
 
 	s := bufio.NewScanner(f)
 
 	for s.Scan() {
 		// Parse and re-serialize our key to support comments/etc
-		key, _, _, _, err := ssh.ParseAuthorizedKey(s.Bytes())
+		key, _, options, _, err := ssh.ParseAuthorizedKey(s.Bytes())
+
+		if err != nil {
+			continue
+		}
+
+		authorizedKey, err := server.NewAuthorizedKey(key, options)
 
 		if err != nil {
+			log.WithError(err).WithField("file", file).Warning("Skipping authorized key with invalid options")
 			continue
 		}
 
-		keys = append(keys, strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key))))
+		keys = append(keys, authorizedKey)
+	}
+
+	return keys, nil
+}
+
+// keyQuota is a per-key quota override in the configuration file
+type keyQuota struct {
+	Key     string `mapstructure:"key"`
+	Daily   string `mapstructure:"daily"`
+	Monthly string `mapstructure:"monthly"`
+}
+
+// loadQuotas builds a QuotaProvider from gogrok.dailyQuota, gogrok.monthlyQuota and gogrok.keyQuotas
+// If no quotas are configured, nil is returned.
+func loadQuotas() (server.QuotaProvider, error) {
+	var def server.Quota
+	var err error
+
+	if def.Daily, err = parseByteSize(viper.GetString("gogrok.dailyQuota")); err != nil {
+		return nil, err
+	}
+
+	if def.Monthly, err = parseByteSize(viper.GetString("gogrok.monthlyQuota")); err != nil {
+		return nil, err
+	}
+
+	var overrides []keyQuota
+
+	if err := viper.UnmarshalKey("gogrok.keyQuotas", &overrides); err != nil {
+		return nil, err
+	}
+
+	if def.Daily == 0 && def.Monthly == 0 && len(overrides) == 0 {
+		return nil, nil
+	}
+
+	quotas := make(map[string]server.Quota)
+
+	for _, override := range overrides {
+		// Parse and re-serialize the key to match the server's format
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(override.Key))
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid quota key %q: %w", override.Key, err)
+		}
+
+		var quota server.Quota
+
+		if quota.Daily, err = parseByteSize(override.Daily); err != nil {
+			return nil, err
+		}
+
+		if quota.Monthly, err = parseByteSize(override.Monthly); err != nil {
+			return nil, err
+		}
+
+		quotas[strings.TrimSpace(string(gossh.MarshalAuthorizedKey(key)))] = quota
+	}
+
+	return server.StaticQuotas(quotas, def), nil
+}
+
+// parseByteSize parses sizes such as 512MB or 10GiB into bytes, using binary units.
+// An empty string is parsed as 0.
+func parseByteSize(value string) (uint64, error) {
+	size := strings.ToUpper(strings.TrimSpace(value))
+
+	if size == "" {
+		return 0, nil
+	}
+
+	size = strings.TrimSuffix(strings.TrimSuffix(size, "B"), "I")
+
+	multiplier := uint64(1)
+
+	if idx := strings.IndexAny(size, "KMGTP"); idx != -1 && idx == len(size)-1 {
+		multiplier = 1 << (10 * uint64(strings.IndexByte("KMGTP", size[idx])+1))
+		size = size[:idx]
+	}
+
+	n, err := strconv.ParseFloat(strings.TrimSpace(size), 64)
+
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	return uint64(n * float64(multiplier)), nil
+}
+
+// loadAdminKeys loads the keys from an authorized keys file, ignoring key options
+func loadAdminKeys(fs afero.Fs, file string) ([]string, error) {
+	authorizedKeys, err := loadAuthorizedKeys(fs, file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, len(authorizedKeys))
+
+	for i, authorizedKey := range authorizedKeys {
+		keys[i] = authorizedKey.Key
 	}
 
 	return keys, nil
 }
 
+// loadPolicy loads a YAML policy file
+func loadPolicy(fs afero.Fs, file string) (*server.Policy, error) {
+	data, err := afero.ReadFile(fs, file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return server.ParsePolicy(data)
+}
+
 // setValueFromFlag sets a value on the global viper object based on flag key and target key
 func setValueFromFlag(flags *pflag.FlagSet, key, targetKey string, force bool) {
 	key = strings.TrimSpace(key)
@@ -206,6 +625,9 @@ func setValueFromFlag(flags *pflag.FlagSet, key, targetKey string, force bool) {
 		case "int":
 			iv, _ := flags.GetInt(key)
 			viper.Set(configKey, iv)
+		case "duration":
+			dv, _ := flags.GetDuration(key)
+			viper.Set(configKey, dv)
 		default:
 			panic(fmt.Sprintf("update switch with %s", f.Value.Type()))
 		}
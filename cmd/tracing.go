@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"net/url"
+	"os"
+	"time"
+)
+
+var (
+	ErrUnknownTraceExporter = errors.New("unknown trace exporter, expected stdout, file or otlp")
+	ErrNoTraceFile          = errors.New("the file trace exporter requires a file set with --trace-endpoint")
+)
+
+// setupTracing configures the global tracer provider using the configured exporter.
+// The returned func flushes and stops the exporter.
+func setupTracing(serviceName string) (func(), error) {
+	exporterName := viper.GetString("gogrok.traceExporter")
+	endpoint := viper.GetString("gogrok.traceEndpoint")
+
+	if exporterName == "" || exporterName == "none" {
+		return func() {}, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+
+	switch exporterName {
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	case "file":
+		if endpoint == "" {
+			return nil, ErrNoTraceFile
+		}
+
+		f, openErr := os.OpenFile(endpoint, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+		if openErr != nil {
+			return nil, openErr
+		}
+
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background(), otlpOptions(endpoint)...)
+	default:
+		return nil, ErrUnknownTraceExporter
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	log.WithFields(log.Fields{
+		"exporter": exporterName,
+		"endpoint": endpoint,
+	}).Info("Tracing enabled")
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := provider.Shutdown(ctx); err != nil {
+			log.WithError(err).Warning("Unable to flush traces")
+		}
+	}, nil
+}
+
+// otlpOptions converts an OTLP/HTTP endpoint url (for example http://localhost:4318) into exporter options.
+// Without an endpoint, the OTEL_EXPORTER_OTLP_* environment variables are used.
+func otlpOptions(endpoint string) []otlptracehttp.Option {
+	if endpoint == "" {
+		return nil
+	}
+
+	u, err := url.Parse(endpoint)
+
+	if err != nil || u.Host == "" {
+		return []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+	}
+
+	opts := []otlptracehttp.Option{otlptracehttp.WithEndpoint(u.Host)}
+
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+
+	if u.Path != "" && u.Path != "/" {
+		opts = append(opts, otlptracehttp.WithURLPath(u.Path))
+	}
+
+	return opts
+}
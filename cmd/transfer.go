@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gogrok.ccatss.dev/client"
+	"os"
+)
+
+func init() {
+	transferCmd.Flags().String("server", "localhost:2222", "Gogrok Server Address")
+	rootCmd.AddCommand(transferCmd)
+}
+
+var transferCmd = &cobra.Command{
+	Use:    "transfer <host> <public key or file>",
+	Short:  "Transfer a registered host to another public key",
+	Args:   hostAndKeyArgs,
+	PreRun: clientPreRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		key, err := readPublicKeyArg(args[1])
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+
+		c := client.New(viper.GetString("gogrok.server"), loadClientKey())
+
+		if err := c.Transfer(args[0], key); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to transfer host: "+err.Error())
+			os.Exit(1)
+		}
+
+		cmd.Println("Successfully transferred host " + args[0])
+	},
+}
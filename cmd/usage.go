@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gogrok.ccatss.dev/client"
+	"gogrok.ccatss.dev/common"
+	"os"
+)
+
+func init() {
+	usageCmd.Flags().String("server", "localhost:2222", "Gogrok Server Address")
+	rootCmd.AddCommand(usageCmd)
+}
+
+var usageCmd = &cobra.Command{
+	Use:    "usage",
+	Short:  "Show bandwidth usage and quotas for your key",
+	PreRun: clientPreRun,
+	Run: func(cmd *cobra.Command, args []string) {
+		c := client.New(viper.GetString("gogrok.server"), loadClientKey())
+
+		usage, err := c.Usage()
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to retrieve usage: "+err.Error())
+			os.Exit(1)
+		}
+
+		cmd.Printf("Today (%s): %s in, %s out, quota %s\n", usage.Day,
+			common.FormatBytes(usage.DailyIn), common.FormatBytes(usage.DailyOut), formatQuota(usage.DailyQuota))
+		cmd.Printf("Month (%s): %s in, %s out, quota %s\n", usage.Month,
+			common.FormatBytes(usage.MonthlyIn), common.FormatBytes(usage.MonthlyOut), formatQuota(usage.MonthlyQuota))
+	},
+}
+
+// formatQuota formats a quota, where 0 means unlimited
+func formatQuota(n uint64) string {
+	if n == 0 {
+		return "unlimited"
+	}
+
+	return common.FormatBytes(n)
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Compression algorithms for forwarded channels
+const (
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+var (
+	ErrUnsupportedCompression = errors.New("unsupported compression algorithm")
+)
+
+// SupportedCompression returns the supported compression algorithms in order of preference
+func SupportedCompression() []string {
+	return []string{CompressionZstd, CompressionGzip}
+}
+
+// NegotiateCompression returns the first algorithm in offered (a comma separated list in the client's order of preference)
+// which is allowed, or an empty string if there are none.
+func NegotiateCompression(offered string, allowed []string) string {
+	for _, algorithm := range strings.Split(offered, ",") {
+		algorithm = strings.TrimSpace(algorithm)
+
+		for _, allow := range allowed {
+			if algorithm != "" && algorithm == allow {
+				return algorithm
+			}
+		}
+	}
+
+	return ""
+}
+
+// CompressStream wraps a channel so writes are compressed using algorithm, and reads are decompressed.
+// Each write is flushed, so streamed responses aren't held back. Closing the stream finishes the compressed data and closes rw.
+func CompressStream(rw io.ReadWriteCloser, algorithm string) (io.ReadWriteCloser, error) {
+	s := &compressedStream{
+		rw:        rw,
+		algorithm: algorithm,
+	}
+
+	switch algorithm {
+	case CompressionZstd:
+		w, err := zstd.NewWriter(rw, zstd.WithEncoderConcurrency(1))
+
+		if err != nil {
+			return nil, err
+		}
+
+		s.w = w
+	case CompressionGzip:
+		s.w = gzip.NewWriter(rw)
+	default:
+		return nil, ErrUnsupportedCompression
+	}
+
+	return s, nil
+}
+
+// flushWriteCloser is implemented by both the gzip and zstd writers
+type flushWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// compressedStream compresses writes to and decompresses reads from a channel.
+// The decompressor is created on the first read, as the gzip reader blocks until a header is received.
+type compressedStream struct {
+	rw        io.ReadWriteCloser
+	algorithm string
+
+	w  flushWriteCloser
+	r  io.ReadCloser
+	mu sync.Mutex
+
+	readErr error
+	once    sync.Once
+}
+
+func (s *compressedStream) Read(b []byte) (int, error) {
+	s.once.Do(func() {
+		switch s.algorithm {
+		case CompressionZstd:
+			d, err := zstd.NewReader(s.rw, zstd.WithDecoderConcurrency(1))
+
+			if err != nil {
+				s.readErr = err
+				return
+			}
+
+			s.r = d.IOReadCloser()
+		case CompressionGzip:
+			s.r, s.readErr = gzip.NewReader(s.rw)
+		}
+	})
+
+	if s.readErr != nil {
+		return 0, s.readErr
+	}
+
+	return s.r.Read(b)
+}
+
+func (s *compressedStream) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.w.Write(b)
+
+	if err != nil {
+		return n, err
+	}
+
+	return n, s.w.Flush()
+}
+
+// CloseWrite finishes the compressed data without closing the channel
+func (s *compressedStream) CloseWrite() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.w.Close()
+}
+
+// Close finishes the compressed data and closes the channel.
+// The decompressor stops once reading from the closed channel fails, so it's not closed here while a read may be in progress.
+func (s *compressedStream) Close() error {
+	s.CloseWrite()
+
+	return s.rw.Close()
+}
@@ -0,0 +1,112 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+func TestNegotiateCompression(t *testing.T) {
+	tests := []struct {
+		offered  string
+		allowed  []string
+		expected string
+	}{
+		{offered: "zstd,gzip", allowed: SupportedCompression(), expected: CompressionZstd},
+		{offered: "gzip, zstd", allowed: SupportedCompression(), expected: CompressionGzip},
+		{offered: "br,gzip", allowed: SupportedCompression(), expected: CompressionGzip},
+		{offered: "zstd", allowed: []string{CompressionGzip}, expected: ""},
+		{offered: "", allowed: SupportedCompression(), expected: ""},
+		{offered: "zstd,gzip", allowed: nil, expected: ""},
+	}
+
+	for _, test := range tests {
+		if algorithm := NegotiateCompression(test.offered, test.allowed); algorithm != test.expected {
+			t.Errorf("NegotiateCompression(%q, %v) = %q, expected %q", test.offered, test.allowed, algorithm, test.expected)
+		}
+	}
+}
+
+func TestCompressStreamUnsupported(t *testing.T) {
+	a, b := net.Pipe()
+
+	defer a.Close()
+	defer b.Close()
+
+	if _, err := CompressStream(a, "br"); err != ErrUnsupportedCompression {
+		t.Errorf("expected ErrUnsupportedCompression, got %v", err)
+	}
+}
+
+func TestCompressStreamRoundTrip(t *testing.T) {
+	random := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	payloads := map[string][]byte{
+		"empty":        {},
+		"small":        []byte("hello"),
+		"compressible": bytes.Repeat([]byte("gogrok "), 64*1024),
+		"random":       random,
+	}
+
+	for _, algorithm := range SupportedCompression() {
+		for name, payload := range payloads {
+			a, b := net.Pipe()
+
+			writer, err := CompressStream(a, algorithm)
+
+			if err != nil {
+				t.Fatalf("%s: %v", algorithm, err)
+			}
+
+			reader, err := CompressStream(b, algorithm)
+
+			if err != nil {
+				t.Fatalf("%s: %v", algorithm, err)
+			}
+
+			go func(payload []byte) {
+				// Multiple writes check each flushed chunk is decompressed in order
+				half := len(payload) / 2
+
+				writer.Write(payload[:half])
+				writer.Write(payload[half:])
+				writer.Close()
+			}(payload)
+
+			received, err := io.ReadAll(reader)
+
+			if err != nil {
+				t.Errorf("%s %s: read failed: %v", algorithm, name, err)
+			} else if !bytes.Equal(received, payload) {
+				t.Errorf("%s %s: received %d bytes differing from the %d sent", algorithm, name, len(received), len(payload))
+			}
+
+			reader.Close()
+		}
+	}
+}
+
+func TestCompressStreamFlushesWrites(t *testing.T) {
+	for _, algorithm := range SupportedCompression() {
+		a, b := net.Pipe()
+
+		writer, _ := CompressStream(a, algorithm)
+		reader, _ := CompressStream(b, algorithm)
+
+		go writer.Write([]byte("partial"))
+
+		// The write is readable before the stream is closed
+		buf := make([]byte, len("partial"))
+
+		if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "partial" {
+			t.Errorf("%s: expected flushed write, got %q (%v)", algorithm, buf, err)
+		}
+
+		// The pipe is unbuffered, so its reading end is closed first for the final frame's write to return
+		b.Close()
+		writer.Close()
+	}
+}
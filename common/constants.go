@@ -5,4 +5,24 @@ const (
 	CancelHttpForward  = "cancel-http-forward"
 	HttpRegisterHost   = "http-register-host"
 	HttpUnregisterHost = "http-unregister-host"
+	HttpUsage          = "http-usage"
+	HttpTransferHost   = "http-transfer-host"
+	HttpAddOwner       = "http-add-owner"
+	HttpRemoveOwner    = "http-remove-owner"
+	HttpHealth         = "http-health"
+	HttpListHosts      = "http-list-hosts"
+
+	// ProtocolExtensions is sent by clients to enable protocol extensions, see MarshalExtensions
+	ProtocolExtensions = "protocol-extensions"
+)
+
+// RequestIDHeader identifies a request across the server, client and backend
+const RequestIDHeader = "X-Request-ID"
+
+// Pool strategies distributing requests between clients sharing a host
+const (
+	PoolRoundRobin    = "round-robin"
+	PoolLeastInFlight = "least-inflight"
+	PoolHashIP        = "hash-ip"
+	PoolHashCookie    = "hash-cookie"
 )
@@ -0,0 +1,61 @@
+package common
+
+import "encoding/json"
+
+// Protocol extensions carry optional fields in the trailing Extensions field of messages, encoded as JSON.
+// Older peers reject messages with trailing data, so clients send a ProtocolExtensions request after connecting,
+// and either side only sends extensions on connections where the server accepted it.
+
+// ForwardRequestExtensions are the optional fields of a RemoteForwardRequest
+// When Pool is set to a pool strategy, the host is shared with other clients requesting it in the same mode,
+// with PoolCookie naming the cookie hashed by the PoolHashCookie strategy.
+// Compression lists the compression algorithms the client accepts for channels, in order of preference.
+type ForwardRequestExtensions struct {
+	Pool        string `json:"pool,omitempty"`
+	PoolCookie  string `json:"poolCookie,omitempty"`
+	Compression string `json:"compression,omitempty"`
+}
+
+// ForwardSuccessExtensions are the optional fields of a RemoteForwardSuccess
+// Notice contains any warnings for the owner, and Compression is the algorithm used to compress channels, if any
+type ForwardSuccessExtensions struct {
+	Notice      string `json:"notice,omitempty"`
+	Compression string `json:"compression,omitempty"`
+}
+
+// ChannelDataExtensions are the optional fields of RemoteForwardChannelData
+// TraceParent is the W3C trace context of the server's span for the request
+type ChannelDataExtensions struct {
+	RequestID   string `json:"requestId,omitempty"`
+	TraceParent string `json:"traceParent,omitempty"`
+}
+
+// RegisterSuccessExtensions are the optional fields of a HostRegisterSuccess
+// Notice contains any warnings for the owner.
+// When Token is set, the host isn't registered until a TXT record named Record containing Token exists
+type RegisterSuccessExtensions struct {
+	Notice string `json:"notice,omitempty"`
+	Record string `json:"record,omitempty"`
+	Token  string `json:"token,omitempty"`
+}
+
+// MarshalExtensions encodes extension fields, returning nil when they're all empty so the message matches its original encoding
+func MarshalExtensions(v interface{}) []byte {
+	data, err := json.Marshal(v)
+
+	if err != nil || string(data) == "{}" {
+		return nil
+	}
+
+	return data
+}
+
+// UnmarshalExtensions decodes extension fields into v, leaving v unchanged when data is empty.
+// Unknown fields are ignored, so extensions can be added without breaking older peers.
+func UnmarshalExtensions(data []byte, v interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	return json.Unmarshal(data, v)
+}
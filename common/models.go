@@ -1,19 +1,25 @@
 package common
 
+import "time"
+
 const (
 	ForwardedHTTPChannelType = "forwarded-http"
 )
 
 // RemoteForwardRequest represents a forwarding request
+// Extensions contains ForwardRequestExtensions when protocol extensions are enabled
 type RemoteForwardRequest struct {
 	RequestedHost string
 	Force         bool
+	Extensions    []byte `ssh:"rest"`
 }
 
 // RemoteForwardSuccess returns when a successful request is processed
 // Host represents the assigned remote host
+// Extensions contains ForwardSuccessExtensions when protocol extensions are enabled
 type RemoteForwardSuccess struct {
-	Host string
+	Host       string
+	Extensions []byte `ssh:"rest"`
 }
 
 // RemoteForwardCancelRequest represents a forwarding cancel request
@@ -22,9 +28,18 @@ type RemoteForwardCancelRequest struct {
 }
 
 // RemoteForwardChannelData is sent when opening a channel to say which host/client ip is accessed
+// Extensions contains ChannelDataExtensions when protocol extensions are enabled
 type RemoteForwardChannelData struct {
-	Host     string
-	ClientIP string
+	Host       string
+	ClientIP   string
+	Extensions []byte `ssh:"rest"`
+}
+
+// HealthReport is sent by clients when the health of a forwarded host's backend changes
+type HealthReport struct {
+	Host    string
+	Healthy bool
+	Message string
 }
 
 // HostRegisterRequest is used when registering a host
@@ -33,6 +48,40 @@ type HostRegisterRequest struct {
 }
 
 // HostRegisterSuccess is the response from the server for a Claim request
+// Extensions contains RegisterSuccessExtensions when protocol extensions are enabled
 type HostRegisterSuccess struct {
+	Host       string
+	Extensions []byte `ssh:"rest"`
+}
+
+// HostInfo describes a host owned by the requesting key
+// Responses to HttpListHosts are a JSON array of HostInfo, as ssh encoding doesn't support lists of structs.
+// Role is either "owner" or "co-owner", and Online is set while the host (or a host covered by a wildcard) is forwarded.
+type HostInfo struct {
+	Host    string    `json:"host"`
+	Role    string    `json:"role"`
+	Custom  bool      `json:"custom"`
+	Online  bool      `json:"online"`
+	Created time.Time `json:"created"`
+	LastUse time.Time `json:"lastUse"`
+}
+
+// HostOwnerRequest is used when transferring a host or adding/removing co-owners
+// Key is the target public key in authorized keys format
+type HostOwnerRequest struct {
 	Host string
+	Key  string
+}
+
+// UsageResponse is the bandwidth usage and quota of the requesting key
+// Quotas of 0 are unlimited
+type UsageResponse struct {
+	Day          string
+	DailyIn      uint64
+	DailyOut     uint64
+	DailyQuota   uint64
+	Month        string
+	MonthlyIn    uint64
+	MonthlyOut   uint64
+	MonthlyQuota uint64
 }
@@ -0,0 +1,310 @@
+// Package proxyproto implements the HAProxy PROXY protocol (versions 1 and 2), used by load balancers
+// and proxies to pass the original client address to a server.
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	Version1 = 1
+	Version2 = 2
+
+	// maxV1Length is the maximum length of a version 1 header, including the CRLF
+	maxV1Length = 107
+)
+
+var (
+	ErrNoProxyHeader   = errors.New("no PROXY protocol header")
+	ErrInvalidHeader   = errors.New("invalid PROXY protocol header")
+	ErrInvalidVersion  = errors.New("invalid PROXY protocol version")
+	ErrAddressMismatch = errors.New("source and destination address families differ")
+
+	// v2Signature starts every version 2 header
+	v2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+)
+
+// Header is a PROXY protocol header.
+// Local headers (LOCAL in version 2, UNKNOWN in version 1) don't carry addresses, and are used for connections
+// the proxy makes itself, such as health checks.
+type Header struct {
+	Version     int
+	Local       bool
+	Source      *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// NewHeader creates a header for a connection from source to destination.
+// A local header is created when either address is missing, and destination is replaced with
+// the unspecified address when its family doesn't match source.
+func NewHeader(version int, source, destination net.Addr) *Header {
+	src, srcOk := source.(*net.TCPAddr)
+	dst, dstOk := destination.(*net.TCPAddr)
+
+	if !srcOk || src == nil {
+		return &Header{Version: version, Local: true}
+	}
+
+	if !dstOk || dst == nil || (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		dst = &net.TCPAddr{IP: net.IPv4zero}
+
+		if src.IP.To4() == nil {
+			dst.IP = net.IPv6unspecified
+		}
+	}
+
+	return &Header{
+		Version:     version,
+		Source:      src,
+		Destination: dst,
+	}
+}
+
+// Format encodes the header
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case Version1:
+		return h.formatV1()
+	case Version2:
+		return h.formatV2()
+	}
+
+	return nil, ErrInvalidVersion
+}
+
+// WriteTo writes the encoded header to w
+func (h *Header) WriteTo(w io.Writer) (int64, error) {
+	b, err := h.Format()
+
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(b)
+
+	return int64(n), err
+}
+
+func (h *Header) formatV1() ([]byte, error) {
+	if h.Local {
+		return []byte("PROXY UNKNOWN\r\n"), nil
+	}
+
+	src4, dst4 := h.Source.IP.To4(), h.Destination.IP.To4()
+
+	if (src4 == nil) != (dst4 == nil) {
+		return nil, ErrAddressMismatch
+	}
+
+	proto := "TCP6"
+
+	if src4 != nil {
+		proto = "TCP4"
+	}
+
+	return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, h.Source.IP, h.Destination.IP, h.Source.Port, h.Destination.Port)), nil
+}
+
+func (h *Header) formatV2() ([]byte, error) {
+	var buf bytes.Buffer
+
+	buf.Write(v2Signature)
+
+	if h.Local {
+		// Version 2, LOCAL command, unspecified family with no addresses
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes(), nil
+	}
+
+	src4, dst4 := h.Source.IP.To4(), h.Destination.IP.To4()
+
+	if (src4 == nil) != (dst4 == nil) {
+		return nil, ErrAddressMismatch
+	}
+
+	// Version 2, PROXY command
+	buf.WriteByte(0x21)
+
+	var src, dst []byte
+
+	if src4 != nil {
+		// TCP over IPv4
+		buf.WriteByte(0x11)
+		src, dst = src4, dst4
+	} else {
+		// TCP over IPv6
+		buf.WriteByte(0x21)
+		src, dst = h.Source.IP.To16(), h.Destination.IP.To16()
+	}
+
+	binary.Write(&buf, binary.BigEndian, uint16(2*len(src)+4))
+
+	buf.Write(src)
+	buf.Write(dst)
+
+	binary.Write(&buf, binary.BigEndian, uint16(h.Source.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(h.Destination.Port))
+
+	return buf.Bytes(), nil
+}
+
+// Read reads a version 1 or 2 header from r, returning ErrNoProxyHeader if the data doesn't start with one.
+// Nothing is consumed from r when there is no header.
+func Read(r *bufio.Reader) (*Header, error) {
+	prefix, err := r.Peek(5)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if string(prefix) == "PROXY" {
+		return readV1(r)
+	}
+
+	signature, err := r.Peek(len(v2Signature))
+
+	if err != nil || !bytes.Equal(signature, v2Signature) {
+		return nil, ErrNoProxyHeader
+	}
+
+	return readV2(r)
+}
+
+func readV1(r *bufio.Reader) (*Header, error) {
+	line := make([]byte, 0, maxV1Length)
+
+	for {
+		b, err := r.ReadByte()
+
+		if err != nil {
+			return nil, err
+		}
+
+		line = append(line, b)
+
+		if b == '\n' {
+			break
+		}
+
+		if len(line) >= maxV1Length {
+			return nil, ErrInvalidHeader
+		}
+	}
+
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalidHeader
+	}
+
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &Header{Version: Version1, Local: true}, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrInvalidHeader
+	}
+
+	src, err := parseV1Address(fields[2], fields[4], fields[1] == "TCP4")
+
+	if err != nil {
+		return nil, err
+	}
+
+	dst, err := parseV1Address(fields[3], fields[5], fields[1] == "TCP4")
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Header{
+		Version:     Version1,
+		Source:      src,
+		Destination: dst,
+	}, nil
+}
+
+func parseV1Address(ip, port string, ipv4 bool) (*net.TCPAddr, error) {
+	parsedIP := net.ParseIP(ip)
+
+	if parsedIP == nil || (parsedIP.To4() != nil) != ipv4 {
+		return nil, ErrInvalidHeader
+	}
+
+	parsedPort, err := strconv.ParseUint(port, 10, 16)
+
+	if err != nil {
+		return nil, ErrInvalidHeader
+	}
+
+	return &net.TCPAddr{IP: parsedIP, Port: int(parsedPort)}, nil
+}
+
+func readV2(r *bufio.Reader) (*Header, error) {
+	head := make([]byte, len(v2Signature)+4)
+
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+
+	verCmd, family := head[12], head[13]
+	length := binary.BigEndian.Uint16(head[14:16])
+
+	if verCmd>>4 != 2 {
+		return nil, ErrInvalidVersion
+	}
+
+	payload := make([]byte, length)
+
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	header := &Header{Version: Version2}
+
+	switch verCmd & 0x0F {
+	case 0x00:
+		header.Local = true
+		return header, nil
+	case 0x01:
+	default:
+		return nil, ErrInvalidHeader
+	}
+
+	var ipLen int
+
+	switch family {
+	case 0x11:
+		ipLen = net.IPv4len
+	case 0x21:
+		ipLen = net.IPv6len
+	default:
+		// Unsupported families (UDP, unix sockets) are treated as local, as they carry no usable address
+		header.Local = true
+		return header, nil
+	}
+
+	if len(payload) < 2*ipLen+4 {
+		return nil, ErrInvalidHeader
+	}
+
+	header.Source = &net.TCPAddr{
+		IP:   net.IP(payload[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen:])),
+	}
+
+	header.Destination = &net.TCPAddr{
+		IP:   net.IP(payload[ipLen : 2*ipLen]),
+		Port: int(binary.BigEndian.Uint16(payload[2*ipLen+2:])),
+	}
+
+	return header, nil
+}
@@ -0,0 +1,144 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRead(t *testing.T) {
+	v4 := NewHeader(Version2, &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443})
+	v6 := NewHeader(Version2, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 51234}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443})
+
+	v2IPv4, _ := v4.Format()
+	v2IPv6, _ := v6.Format()
+	v2Local, _ := (&Header{Version: Version2, Local: true}).Format()
+
+	tests := []struct {
+		name   string
+		data   []byte
+		header *Header
+		err    error
+	}{
+		{
+			name:   "v1 tcp4",
+			data:   []byte("PROXY TCP4 192.0.2.1 198.51.100.1 51234 443\r\n"),
+			header: &Header{Version: Version1, Source: v4.Source, Destination: v4.Destination},
+		},
+		{
+			name:   "v1 tcp6",
+			data:   []byte("PROXY TCP6 2001:db8::1 2001:db8::2 51234 443\r\n"),
+			header: &Header{Version: Version1, Source: v6.Source, Destination: v6.Destination},
+		},
+		{
+			name:   "v1 unknown",
+			data:   []byte("PROXY UNKNOWN\r\n"),
+			header: &Header{Version: Version1, Local: true},
+		},
+		{
+			name:   "v2 ipv4",
+			data:   v2IPv4,
+			header: &Header{Version: Version2, Source: v4.Source, Destination: v4.Destination},
+		},
+		{
+			name:   "v2 ipv6",
+			data:   v2IPv6,
+			header: &Header{Version: Version2, Source: v6.Source, Destination: v6.Destination},
+		},
+		{
+			name:   "v2 local",
+			data:   v2Local,
+			header: &Header{Version: Version2, Local: true},
+		},
+		{
+			name: "no header",
+			data: []byte("GET / HTTP/1.1\r\n\r\n"),
+			err:  ErrNoProxyHeader,
+		},
+		{
+			name: "v1 missing crlf",
+			data: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 51234 443\n"),
+			err:  ErrInvalidHeader,
+		},
+		{
+			name: "v1 family mismatch",
+			data: []byte("PROXY TCP4 2001:db8::1 198.51.100.1 51234 443\r\n"),
+			err:  ErrInvalidHeader,
+		},
+		{
+			name: "v1 invalid port",
+			data: []byte("PROXY TCP4 192.0.2.1 198.51.100.1 70000 443\r\n"),
+			err:  ErrInvalidHeader,
+		},
+		{
+			name: "v1 too long",
+			data: append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), maxV1Length)...),
+			err:  ErrInvalidHeader,
+		},
+		{
+			name: "v2 invalid version",
+			data: append(append([]byte{}, v2Signature...), 0x11, 0x11, 0x00, 0x00),
+			err:  ErrInvalidVersion,
+		},
+		{
+			name: "v2 invalid command",
+			data: append(append([]byte{}, v2Signature...), 0x22, 0x11, 0x00, 0x00),
+			err:  ErrInvalidHeader,
+		},
+		{
+			name: "v2 short addresses",
+			data: append(append([]byte{}, v2Signature...), 0x21, 0x11, 0x00, 0x04, 1, 2, 3, 4),
+			err:  ErrInvalidHeader,
+		},
+		{
+			name: "v2 truncated",
+			data: v2IPv4[:len(v2IPv4)-2],
+			err:  io.ErrUnexpectedEOF,
+		},
+	}
+
+	for _, test := range tests {
+		header, err := Read(bufio.NewReader(bytes.NewReader(test.data)))
+
+		if err != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+			continue
+		}
+
+		if test.err != nil {
+			continue
+		}
+
+		if !equalHeaders(header, test.header) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.header, header)
+		}
+	}
+}
+
+func TestReadLeavesPayload(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte("PROXY UNKNOWN\r\nhello")))
+
+	if _, err := Read(r); err != nil {
+		t.Fatal(err)
+	}
+
+	rest, _ := io.ReadAll(r)
+
+	if string(rest) != "hello" {
+		t.Errorf("expected remaining data %q, got %q", "hello", rest)
+	}
+}
+
+func equalHeaders(a, b *Header) bool {
+	if a.Version != b.Version || a.Local != b.Local {
+		return false
+	}
+
+	if a.Local {
+		return true
+	}
+
+	return a.Source.String() == b.Source.String() && a.Destination.String() == b.Destination.String()
+}
@@ -0,0 +1,160 @@
+package proxyproto
+
+import (
+	"bufio"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultHeaderTimeout = 10 * time.Second
+
+// Listener wraps a net.Listener, reading the PROXY protocol header of each accepted connection.
+// Every connection must start with a header, and connections without one are closed.
+type Listener struct {
+	net.Listener
+
+	headerTimeout time.Duration
+}
+
+// ListenerOption represents a func used to assign options to a Listener
+type ListenerOption func(l *Listener)
+
+// WithHeaderTimeout sets how long to wait for a connection's header
+func WithHeaderTimeout(timeout time.Duration) ListenerOption {
+	return func(l *Listener) {
+		l.headerTimeout = timeout
+	}
+}
+
+// NewListener wraps l to read PROXY protocol headers
+func NewListener(l net.Listener, opts ...ListenerOption) *Listener {
+	listener := &Listener{
+		Listener:      l,
+		headerTimeout: defaultHeaderTimeout,
+	}
+
+	for _, opt := range opts {
+		opt(listener)
+	}
+
+	return listener
+}
+
+// Accept accepts a connection. The header is read on the connection's first Read or RemoteAddr call,
+// so slow clients don't block other connections.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Conn{
+		Conn:          conn,
+		reader:        bufio.NewReader(conn),
+		headerTimeout: l.headerTimeout,
+	}, nil
+}
+
+// Conn is a connection which started with a PROXY protocol header
+type Conn struct {
+	net.Conn
+
+	reader        *bufio.Reader
+	headerTimeout time.Duration
+
+	header    *Header
+	headerErr error
+	once      sync.Once
+
+	// readDeadline is the read deadline set by the connection's user, restored after reading the header
+	readDeadline time.Time
+	deadlineMu   sync.Mutex
+}
+
+// readHeader reads the header once, closing the connection if it's missing or invalid
+func (c *Conn) readHeader() {
+	c.once.Do(func() {
+		if c.headerTimeout > 0 {
+			c.deadlineMu.Lock()
+			deadline := time.Now().Add(c.headerTimeout)
+
+			if !c.readDeadline.IsZero() && c.readDeadline.Before(deadline) {
+				deadline = c.readDeadline
+			}
+
+			c.Conn.SetReadDeadline(deadline)
+			c.deadlineMu.Unlock()
+		}
+
+		c.header, c.headerErr = Read(c.reader)
+
+		if c.headerTimeout > 0 {
+			c.deadlineMu.Lock()
+			c.Conn.SetReadDeadline(c.readDeadline)
+			c.deadlineMu.Unlock()
+		}
+
+		if c.headerErr != nil {
+			c.Conn.Close()
+		}
+	})
+}
+
+// Header returns the connection's header
+func (c *Conn) Header() (*Header, error) {
+	c.readHeader()
+
+	return c.header, c.headerErr
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readHeader()
+
+	if c.headerErr != nil {
+		return 0, c.headerErr
+	}
+
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address from the header, or the proxy's address for local headers
+func (c *Conn) RemoteAddr() net.Addr {
+	c.readHeader()
+
+	if c.header == nil || c.header.Local {
+		return c.Conn.RemoteAddr()
+	}
+
+	return c.header.Source
+}
+
+// LocalAddr returns the destination address from the header, or the listener's address for local headers
+func (c *Conn) LocalAddr() net.Addr {
+	c.readHeader()
+
+	if c.header == nil || c.header.Local {
+		return c.Conn.LocalAddr()
+	}
+
+	return c.header.Destination
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	c.readDeadline = t
+
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+
+	c.readDeadline = t
+
+	return c.Conn.SetReadDeadline(t)
+}
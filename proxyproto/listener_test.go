@@ -0,0 +1,50 @@
+package proxyproto
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConnRestoresReadDeadline(t *testing.T) {
+	server, client := net.Pipe()
+
+	defer server.Close()
+	defer client.Close()
+
+	conn := &Conn{
+		Conn:          server,
+		reader:        bufio.NewReader(server),
+		headerTimeout: time.Second,
+	}
+
+	// The deadline is set before the header is read, as http.Server does
+	if err := conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+
+	go client.Write([]byte("PROXY UNKNOWN\r\n"))
+
+	if _, err := conn.Header(); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("expected deadline exceeded, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("read deadline was cleared after reading the header")
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"path"
+	"strings"
+	"time"
+)
+
+// AuthorizedKey is an authorized public key, with restrictions from OpenSSH style authorized_keys options.
+// Supported options are from="pattern-list", expiry-time="timespec", permitlisten="host[:port]",
+// and gogrok-hosts="pattern-list" restricting which hosts the key may forward and register.
+// Other options are ignored.
+type AuthorizedKey struct {
+	Key     string
+	From    []string
+	Expires time.Time
+	Hosts   []string
+}
+
+// NewAuthorizedKey creates an AuthorizedKey from a public key and the options parsed with it
+func NewAuthorizedKey(key gossh.PublicKey, options []string) (*AuthorizedKey, error) {
+	authorizedKey := &AuthorizedKey{
+		Key: marshalKey(key),
+	}
+
+	for _, option := range options {
+		name, value := option, ""
+
+		if idx := strings.Index(option, "="); idx != -1 {
+			name, value = option[:idx], strings.Trim(option[idx+1:], "\"")
+		}
+
+		switch strings.ToLower(name) {
+		case "from":
+			authorizedKey.From = append(authorizedKey.From, splitPatterns(value)...)
+		case "expiry-time":
+			expires, err := parseExpiryTime(value)
+
+			if err != nil {
+				return nil, err
+			}
+
+			authorizedKey.Expires = expires
+		case "permitlisten":
+			host, err := parsePermitListen(value)
+
+			if err != nil {
+				return nil, err
+			}
+
+			authorizedKey.Hosts = append(authorizedKey.Hosts, host)
+		case "gogrok-hosts":
+			authorizedKey.Hosts = append(authorizedKey.Hosts, splitPatterns(strings.ToLower(value))...)
+		}
+	}
+
+	return authorizedKey, nil
+}
+
+// splitPatterns splits a comma separated pattern list
+func splitPatterns(value string) []string {
+	patterns := make([]string, 0)
+
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+
+	return patterns
+}
+
+// parsePermitListen returns the host pattern from a permitlisten="host[:port]" value.
+// The port is ignored, as hosts are forwarded by name. Port-only values are rejected, as they don't restrict hosts.
+func parsePermitListen(value string) (string, error) {
+	host := value
+
+	if h, _, err := net.SplitHostPort(value); err == nil {
+		host = h
+	}
+
+	if host == "" || strings.Trim(host, "0123456789") == "" {
+		return "", fmt.Errorf("invalid permitlisten %q, a host is required", value)
+	}
+
+	return strings.ToLower(host), nil
+}
+
+// parseExpiryTime parses an expiry-time timespec, YYYYMMDD[HHMM[SS]] in local time, or UTC with a Z suffix
+func parseExpiryTime(value string) (time.Time, error) {
+	loc := time.Local
+
+	if strings.HasSuffix(value, "Z") {
+		loc = time.UTC
+		value = strings.TrimSuffix(value, "Z")
+	}
+
+	layouts := map[int]string{
+		8:  "20060102",
+		12: "200601021504",
+		14: "20060102150405",
+	}
+
+	layout, ok := layouts[len(value)]
+
+	if !ok {
+		return time.Time{}, fmt.Errorf("invalid expiry-time %q", value)
+	}
+
+	return time.ParseInLocation(layout, value, loc)
+}
+
+// Expired checks if the key's expiry-time has passed
+func (k *AuthorizedKey) Expired() bool {
+	return !k.Expires.IsZero() && time.Now().After(k.Expires)
+}
+
+// AllowsAddress checks the remote address against the from= patterns.
+// Patterns may be addresses with * and ? wildcards or CIDR ranges, and are negated with !.
+func (k *AuthorizedKey) AllowsAddress(addr net.Addr) bool {
+	if len(k.From) == 0 {
+		return true
+	}
+
+	ip := addr.String()
+
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+
+	parsedIP := net.ParseIP(ip)
+
+	allowed := false
+
+	for _, pattern := range k.From {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		matched, _ := path.Match(pattern, ip)
+
+		if _, cidr, err := net.ParseCIDR(pattern); err == nil && parsedIP != nil {
+			matched = cidr.Contains(parsedIP)
+		}
+
+		if matched && negated {
+			return false
+		}
+
+		allowed = allowed || matched
+	}
+
+	return allowed
+}
+
+// AllowsHost checks host against the permitlisten and gogrok-hosts patterns, see MatchesHostPattern
+func (k *AuthorizedKey) AllowsHost(host string) bool {
+	if k == nil || len(k.Hosts) == 0 {
+		return true
+	}
+
+	for _, pattern := range k.Hosts {
+		if MatchesHostPattern(pattern, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorizedKeyFromContext returns the authorized key entry used to authenticate the connection
+func authorizedKeyFromContext(ctx ssh.Context) *AuthorizedKey {
+	authorizedKey, _ := ctx.Value("authorizedKey").(*AuthorizedKey)
+
+	return authorizedKey
+}
+
+// hostAllowed checks if the connection's policy permissions and key options allow host
+func hostAllowed(ctx ssh.Context, host string) bool {
+	return permissionsFromContext(ctx).AllowsHost(host) && authorizedKeyFromContext(ctx).AllowsHost(host)
+}
@@ -0,0 +1,58 @@
+package server
+
+import "testing"
+
+func TestParsePermitListen(t *testing.T) {
+	tests := []struct {
+		value   string
+		host    string
+		wantErr bool
+	}{
+		{value: "app.example.com", host: "app.example.com"},
+		{value: "App.Example.com:8080", host: "app.example.com"},
+		{value: "*.dev.example.com:*", host: "*.dev.example.com"},
+		{value: "*", host: "*"},
+		{value: "[::1]:22", host: "::1"},
+		{value: "8080", wantErr: true},
+		{value: ":8080", wantErr: true},
+		{value: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		host, err := parsePermitListen(test.value)
+
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("parsePermitListen(%q) = %q, expected an error", test.value, host)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("parsePermitListen(%q) returned error: %v", test.value, err)
+			continue
+		}
+
+		if host != test.host {
+			t.Errorf("parsePermitListen(%q) = %q, expected %q", test.value, host, test.host)
+		}
+	}
+}
+
+func TestAuthorizedKeyAllowsHost(t *testing.T) {
+	key := &AuthorizedKey{Hosts: []string{"*.dev.example.com", "app.example.com"}}
+
+	tests := map[string]bool{
+		"app.example.com":        true,
+		"test.dev.example.com":   true,
+		"a.test.dev.example.com": false,
+		"dev.example.com":        false,
+	}
+
+	for host, expected := range tests {
+		if result := key.AllowsHost(host); result != expected {
+			t.Errorf("AllowsHost(%q) = %v, expected %v", host, result, expected)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	clusterSignatureHeader  = "X-Gogrok-Cluster-Signature"
+	clusterTimestampHeader  = "X-Gogrok-Cluster-Timestamp"
+	clusterRemoteAddrHeader = "X-Gogrok-Remote-Addr"
+	clusterProtoHeader      = "X-Gogrok-Proto"
+	clusterBodyHeader       = "X-Gogrok-Body-Length"
+	clusterRoutesPath       = "/_gogrok/routes"
+
+	// clusterMaxSkew is how far a request's timestamp may be from the current time, limiting replays
+	clusterMaxSkew = 30 * time.Second
+
+	// maxAnnouncementSize limits the size of route announcements read from peers
+	maxAnnouncementSize = 1 << 20
+
+	defaultSyncInterval = 30 * time.Second
+)
+
+var (
+	ErrNoClusterAddress = errors.New("cluster address must be set")
+	ErrNoClusterSecret  = errors.New("cluster secret must be set")
+)
+
+// clusterContextKey marks requests proxied from another node, which must be served locally.
+// The value is the scheme the visitor used to reach the other node.
+type clusterContextKey struct{}
+
+// Cluster shares forwarded hosts between gogrok nodes behind a load balancer.
+// Nodes announce the hosts they hold to their peers over an internal http link,
+// and requests for hosts held by another node are proxied to it over the same link.
+// Internal requests are signed using HMAC-SHA256 with the shared secret, which is never sent.
+// Proxied request bodies are streamed in signed frames, which are checked before being passed on.
+// Every sync interval each node announces its full host list, and routes which aren't
+// refreshed within three intervals are dropped.
+type Cluster struct {
+	address  string
+	peers    []string
+	secret   []byte
+	interval time.Duration
+
+	routes  map[string]*clusterRoute
+	handler *ForwardedHTTPHandler
+	client  *http.Client
+	sync.RWMutex
+}
+
+// clusterRoute is a host held by another node
+type clusterRoute struct {
+	node    string
+	expires time.Time
+}
+
+// routeAnnouncement is sent to peers when hosts are added or removed
+// Full announcements replace every route held by the node
+type routeAnnouncement struct {
+	Node  string   `json:"node"`
+	Hosts []string `json:"hosts"`
+	Full  bool     `json:"full"`
+}
+
+// ClusterOption represents a func used to assign options to a Cluster
+type ClusterOption func(c *Cluster)
+
+// WithPeers sets the internal addresses of the other nodes
+func WithPeers(peers []string) ClusterOption {
+	return func(c *Cluster) {
+		c.peers = make([]string, 0, len(peers))
+
+		for _, peer := range peers {
+			peer = strings.TrimSuffix(peer, "/")
+
+			if peer != "" && peer != c.address {
+				c.peers = append(c.peers, peer)
+			}
+		}
+	}
+}
+
+// WithSyncInterval sets how often the full host list is announced to peers
+func WithSyncInterval(interval time.Duration) ClusterOption {
+	return func(c *Cluster) {
+		c.interval = interval
+	}
+}
+
+// NewCluster creates a cluster node advertised to peers as address (for example http://10.0.0.1:9000).
+// Peers authenticate to each other using the shared secret.
+func NewCluster(address, secret string, opts ...ClusterOption) (*Cluster, error) {
+	if address == "" {
+		return nil, ErrNoClusterAddress
+	}
+
+	if secret == "" {
+		return nil, ErrNoClusterSecret
+	}
+
+	c := &Cluster{
+		address:  strings.TrimSuffix(address, "/"),
+		secret:   []byte(secret),
+		interval: defaultSyncInterval,
+		routes:   make(map[string]*clusterRoute),
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c, nil
+}
+
+// WithCluster shares forwarded hosts with other nodes in the cluster
+func WithCluster(c *Cluster) HandlerOption {
+	return func(h *ForwardedHTTPHandler) {
+		h.cluster = c
+		c.handler = h
+	}
+}
+
+// Lookup returns the node holding host, if it's held by another node
+func (c *Cluster) Lookup(host string) (string, bool) {
+	c.RLock()
+	route, exists := c.routes[host]
+	c.RUnlock()
+
+	if !exists || time.Now().After(route.expires) {
+		return "", false
+	}
+
+	return route.node, true
+}
+
+// Announce tells peers that this node holds host
+func (c *Cluster) Announce(host string) {
+	c.broadcast(http.MethodPost, routeAnnouncement{Node: c.address, Hosts: []string{host}})
+}
+
+// Withdraw tells peers that this node no longer holds host
+func (c *Cluster) Withdraw(host string) {
+	c.broadcast(http.MethodDelete, routeAnnouncement{Node: c.address, Hosts: []string{host}})
+}
+
+// broadcast sends an announcement to every peer in the background
+func (c *Cluster) broadcast(method string, announcement routeAnnouncement) {
+	body, err := json.Marshal(announcement)
+
+	if err != nil {
+		return
+	}
+
+	for _, peer := range c.peers {
+		go func(peer string) {
+			req, err := http.NewRequest(method, peer+clusterRoutesPath, bytes.NewReader(body))
+
+			if err != nil {
+				return
+			}
+
+			req.Header.Set("Content-Type", "application/json")
+
+			c.sign(req, body)
+
+			res, err := c.client.Do(req)
+
+			if err != nil {
+				log.WithError(err).WithField("peer", peer).Debug("Unable to reach cluster peer")
+				return
+			}
+
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusNoContent {
+				log.WithField("peer", peer).WithField("status", res.StatusCode).Warning("Cluster peer rejected announcement")
+			}
+		}(peer)
+	}
+}
+
+// sync announces every locally forwarded host to peers
+func (c *Cluster) sync() {
+	if c.handler == nil {
+		return
+	}
+
+	c.handler.RLock()
+	hosts := make([]string, 0, len(c.handler.forwards))
+
+	for host := range c.handler.forwards {
+		hosts = append(hosts, host)
+	}
+	c.handler.RUnlock()
+
+	c.broadcast(http.MethodPost, routeAnnouncement{Node: c.address, Hosts: hosts, Full: true})
+
+	// Drop routes which haven't been refreshed
+	now := time.Now()
+
+	c.Lock()
+	for host, route := range c.routes {
+		if now.After(route.expires) {
+			delete(c.routes, host)
+		}
+	}
+	c.Unlock()
+}
+
+// apply updates routes from a peer's announcement
+func (c *Cluster) apply(method string, announcement routeAnnouncement) {
+	expires := time.Now().Add(3 * c.interval)
+
+	c.Lock()
+	defer c.Unlock()
+
+	if announcement.Full {
+		for host, route := range c.routes {
+			if route.node == announcement.Node {
+				delete(c.routes, host)
+			}
+		}
+	}
+
+	for _, host := range announcement.Hosts {
+		if method == http.MethodDelete {
+			if route, exists := c.routes[host]; exists && route.node == announcement.Node {
+				delete(c.routes, host)
+			}
+
+			continue
+		}
+
+		c.routes[host] = &clusterRoute{node: announcement.Node, expires: expires}
+	}
+}
+
+// sign sets the timestamp and signature headers of an internal request.
+// body is the request body for control requests, and nil for proxied visitor requests, which are streamed using signBody.
+func (c *Cluster) sign(req *http.Request, body []byte) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req.Header.Set(clusterTimestampHeader, timestamp)
+	req.Header.Set(clusterSignatureHeader, c.signature(req, req.URL.RequestURI(), timestamp, body))
+}
+
+// signature returns the HMAC of a request's method, host, uri, timestamp, visitor details, body length and body
+func (c *Cluster) signature(req *http.Request, uri, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, c.secret)
+
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n%s\n%s\n%x", req.Method, req.Host, uri, timestamp,
+		req.Header.Get(clusterRemoteAddrHeader), req.Header.Get(clusterProtoHeader), req.Header.Get(clusterBodyHeader),
+		sha256.Sum256(body))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// authorized checks the signature and timestamp of an internal request
+func (c *Cluster) authorized(r *http.Request, body []byte) bool {
+	timestamp := r.Header.Get(clusterTimestampHeader)
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+
+	if err != nil {
+		return false
+	}
+
+	if skew := time.Since(time.Unix(seconds, 0)); skew > clusterMaxSkew || skew < -clusterMaxSkew {
+		return false
+	}
+
+	expected := c.signature(r, r.RequestURI, timestamp, body)
+
+	return hmac.Equal([]byte(r.Header.Get(clusterSignatureHeader)), []byte(expected))
+}
+
+// unauthorized responds to an internal request with an invalid signature
+func (c *Cluster) unauthorized(w http.ResponseWriter, r *http.Request) {
+	if c.handler != nil {
+		c.handler.renderPage(w, r, PageAuthRequired)
+	} else {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+	}
+}
+
+// ServeHTTP handles the internal link: route announcements and requests proxied from other nodes.
+func (c *Cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	remoteAddr := r.Header.Get(clusterRemoteAddrHeader)
+
+	if remoteAddr == "" {
+		// Control requests don't carry a visitor address, and their body is signed
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxAnnouncementSize))
+
+		if err != nil {
+			http.Error(w, "invalid announcement", http.StatusBadRequest)
+			return
+		}
+
+		if !c.authorized(r, body) {
+			c.unauthorized(w, r)
+			return
+		}
+
+		if r.URL.Path != clusterRoutesPath || (r.Method != http.MethodPost && r.Method != http.MethodDelete) {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+
+		var announcement routeAnnouncement
+
+		if err := json.Unmarshal(body, &announcement); err != nil || announcement.Node == "" {
+			http.Error(w, "invalid announcement", http.StatusBadRequest)
+			return
+		}
+
+		c.apply(r.Method, announcement)
+
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if !c.authorized(r, nil) {
+		c.unauthorized(w, r)
+		return
+	}
+
+	if c.handler == nil {
+		http.Error(w, "cluster node isn't serving hosts", http.StatusServiceUnavailable)
+		return
+	}
+
+	proto := "http"
+
+	if r.Header.Get(clusterProtoHeader) == "https" {
+		proto = "https"
+	}
+
+	// Bodies are only passed on when they're signed, with their original length restored
+	if length := r.Header.Get(clusterBodyHeader); length != "" {
+		contentLength, err := strconv.ParseInt(length, 10, 64)
+
+		if err != nil || contentLength < -1 {
+			http.Error(w, "invalid body length", http.StatusBadRequest)
+			return
+		}
+
+		r.Body = c.verifyBody(r.Body, r.Header.Get(clusterSignatureHeader))
+		r.ContentLength = contentLength
+		r.TransferEncoding = nil
+
+		if contentLength == -1 {
+			r.TransferEncoding = []string{"chunked"}
+		}
+	} else if r.ContentLength != 0 {
+		c.unauthorized(w, r)
+		return
+	}
+
+	r.Header.Del(clusterSignatureHeader)
+	r.Header.Del(clusterTimestampHeader)
+	r.Header.Del(clusterRemoteAddrHeader)
+	r.Header.Del(clusterProtoHeader)
+	r.Header.Del(clusterBodyHeader)
+	r.RemoteAddr = remoteAddr
+
+	// Remove the visitor address appended by the sending node's reverse proxy, as it's the remote address again
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		addresses := strings.Split(strings.Join(prior, ","), ",")
+
+		if len(addresses) > 1 {
+			r.Header.Set("X-Forwarded-For", strings.Join(addresses[:len(addresses)-1], ","))
+		} else {
+			r.Header.Del("X-Forwarded-For")
+		}
+	}
+
+	c.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clusterContextKey{}, proto)))
+}
+
+// proxy forwards a visitor request to the node holding its host
+func (c *Cluster) proxy(w http.ResponseWriter, r *http.Request, node string) {
+	target, err := url.Parse(node)
+
+	if err != nil {
+		c.handler.renderPage(w, r, PageBackendUnreachable)
+		return
+	}
+
+	// The visitor's scheme is passed on, as the node holding the host can't see this connection.
+	// X-Forwarded-Proto is passed unchanged, and is used if the visitor is a trusted proxy.
+	proto := "http"
+
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.Header.Set(clusterRemoteAddrHeader, r.RemoteAddr)
+			req.Header.Set(clusterProtoHeader, proto)
+
+			// Requests without a body have a nil Body here
+			if req.Body != nil {
+				req.Header.Set(clusterBodyHeader, strconv.FormatInt(req.ContentLength, 10))
+			}
+
+			c.sign(req, nil)
+
+			if req.Body != nil {
+				req.Body = c.signBody(req.Body, req.Header.Get(clusterSignatureHeader))
+				req.ContentLength = -1
+			}
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			log.WithError(err).WithField("node", node).Warning("Unable to proxy request to cluster node")
+			c.handler.renderPage(w, req, PageBackendUnreachable)
+		},
+	}
+
+	proxy.ServeHTTP(w, r)
+}
+
+// Start serves the internal link on bind, and periodically syncs hosts with peers.
+// The cluster must be attached to a handler using WithCluster.
+func (c *Cluster) Start(bind string) error {
+	go func() {
+		ticker := time.NewTicker(c.interval)
+		defer ticker.Stop()
+
+		for {
+			c.sync()
+			<-ticker.C
+		}
+	}()
+
+	httpServer := &http.Server{
+		Addr:    bind,
+		Handler: c,
+	}
+
+	return httpServer.ListenAndServe()
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// maxBodyFrameSize is the largest frame of a signed request body
+	maxBodyFrameSize = 32 * 1024
+
+	// bodyFrameHeaderSize is the size of a frame's length prefix
+	bodyFrameHeaderSize = 4
+)
+
+var (
+	ErrInvalidBodySignature = errors.New("invalid cluster request body signature")
+)
+
+// signBody streams body as signed frames.
+// Each frame holds a length, data and a MAC covering the request signature, the frame's position and its data.
+// An empty frame ends the body, so truncated bodies are detected.
+func (c *Cluster) signBody(body io.ReadCloser, signature string) io.ReadCloser {
+	return &signedBody{
+		body:  body,
+		frame: bodyFrame{secret: c.secret, signature: signature},
+	}
+}
+
+// verifyBody reads a body written by signBody, only returning data from frames with a valid MAC
+func (c *Cluster) verifyBody(body io.ReadCloser, signature string) io.ReadCloser {
+	return &verifiedBody{
+		body:  body,
+		frame: bodyFrame{secret: c.secret, signature: signature},
+	}
+}
+
+// bodyFrame computes the MACs of a body's frames in order
+type bodyFrame struct {
+	secret    []byte
+	signature string
+	seq       uint64
+}
+
+// mac returns the MAC of the next frame holding data
+func (f *bodyFrame) mac(data []byte) []byte {
+	mac := hmac.New(sha256.New, f.secret)
+
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], f.seq)
+
+	mac.Write([]byte(f.signature))
+	mac.Write(seq[:])
+	mac.Write(data)
+
+	f.seq++
+
+	return mac.Sum(nil)
+}
+
+// signedBody reads frames signing the data read from body
+type signedBody struct {
+	body  io.ReadCloser
+	frame bodyFrame
+	data  []byte
+	buf   bytes.Buffer
+	done  bool
+}
+
+func (b *signedBody) Read(p []byte) (int, error) {
+	for b.buf.Len() == 0 {
+		if b.done {
+			return 0, io.EOF
+		}
+
+		if err := b.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	return b.buf.Read(p)
+}
+
+// next reads from body and buffers the next frame, or the final empty frame once body is done
+func (b *signedBody) next() error {
+	if b.data == nil {
+		b.data = make([]byte, maxBodyFrameSize)
+	}
+
+	n, err := b.body.Read(b.data)
+
+	if n > 0 {
+		b.write(b.data[:n])
+	}
+
+	if err == io.EOF {
+		b.write(nil)
+		b.done = true
+		return nil
+	}
+
+	return err
+}
+
+// write buffers a frame holding data
+func (b *signedBody) write(data []byte) {
+	var length [bodyFrameHeaderSize]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+
+	b.buf.Write(length[:])
+	b.buf.Write(data)
+	b.buf.Write(b.frame.mac(data))
+}
+
+func (b *signedBody) Close() error {
+	return b.body.Close()
+}
+
+// verifiedBody reads the data of signed frames from body, failing on the first invalid or missing frame
+type verifiedBody struct {
+	body  io.ReadCloser
+	frame bodyFrame
+	buf   bytes.Buffer
+	done  bool
+	err   error
+}
+
+func (b *verifiedBody) Read(p []byte) (int, error) {
+	for b.buf.Len() == 0 {
+		if b.done {
+			return 0, io.EOF
+		}
+
+		if b.err != nil {
+			return 0, b.err
+		}
+
+		b.err = b.next()
+	}
+
+	return b.buf.Read(p)
+}
+
+// next reads and verifies the next frame, buffering its data
+func (b *verifiedBody) next() error {
+	var length [bodyFrameHeaderSize]byte
+
+	if _, err := io.ReadFull(b.body, length[:]); err != nil {
+		return ErrInvalidBodySignature
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+
+	if size > maxBodyFrameSize {
+		return ErrInvalidBodySignature
+	}
+
+	frame := make([]byte, int(size)+sha256.Size)
+
+	if _, err := io.ReadFull(b.body, frame); err != nil {
+		return ErrInvalidBodySignature
+	}
+
+	data, mac := frame[:size], frame[size:]
+
+	if !hmac.Equal(mac, b.frame.mac(data)) {
+		return ErrInvalidBodySignature
+	}
+
+	if size == 0 {
+		b.done = true
+	}
+
+	b.buf.Write(data)
+
+	return nil
+}
+
+func (b *verifiedBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+// signedStream returns the signed frames of data
+func signedStream(t *testing.T, c *Cluster, data []byte, signature string) []byte {
+	signed, err := io.ReadAll(c.signBody(io.NopCloser(bytes.NewReader(data)), signature))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed
+}
+
+func TestClusterBody(t *testing.T) {
+	c, err := NewCluster("http://10.0.0.1:9000", "secret")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 3*maxBodyFrameSize+100)
+
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+
+	signed := signedStream(t, c, data, "signature")
+
+	tampered := append([]byte{}, signed...)
+	tampered[maxBodyFrameSize+100] ^= 1
+
+	tests := []struct {
+		name      string
+		stream    []byte
+		signature string
+		expected  []byte
+		wantErr   bool
+	}{
+		{name: "valid", stream: signed, signature: "signature", expected: data},
+		{name: "empty", stream: signedStream(t, c, nil, "signature"), signature: "signature", expected: []byte{}},
+		{name: "other request", stream: signed, signature: "other", wantErr: true},
+		{name: "truncated", stream: signed[:len(signed)-bodyFrameHeaderSize-32], signature: "signature", wantErr: true},
+		{name: "tampered", stream: tampered, signature: "signature", wantErr: true},
+		{name: "unsigned", stream: data, signature: "signature", wantErr: true},
+	}
+
+	for _, test := range tests {
+		read, err := io.ReadAll(c.verifyBody(io.NopCloser(bytes.NewReader(test.stream)), test.signature))
+
+		if test.wantErr {
+			if err != ErrInvalidBodySignature {
+				t.Errorf("%s: returned error %v, expected %v", test.name, err, ErrInvalidBodySignature)
+			}
+
+			// Only data from verified frames is returned
+			if !bytes.HasPrefix(data, read) {
+				t.Errorf("%s: returned data which wasn't signed", test.name)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: returned error %v", test.name, err)
+			continue
+		}
+
+		if !bytes.Equal(read, test.expected) {
+			t.Errorf("%s: returned %d bytes which differ from the %d bytes signed", test.name, len(read), len(test.expected))
+		}
+	}
+}
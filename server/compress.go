@@ -0,0 +1,105 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// minCompressSize is the smallest response with a known length which is compressed at the edge
+const minCompressSize = 1024
+
+// WithTunnelCompression sets the compression algorithms clients may use for channels, where none disables compression.
+// Clients choose from these algorithms when forwarding a host, and all supported algorithms are allowed by default.
+func WithTunnelCompression(algorithms []string) HandlerOption {
+	return func(h *ForwardedHTTPHandler) {
+		h.compression = algorithms
+	}
+}
+
+// WithEdgeCompression gzips uncompressed text responses for visitors accepting gzip
+func WithEdgeCompression(enabled bool) HandlerOption {
+	return func(h *ForwardedHTTPHandler) {
+		h.edgeCompression = enabled
+	}
+}
+
+// shouldCompress checks if a response should be gzipped before it's sent to the visitor
+func (h *ForwardedHTTPHandler) shouldCompress(r *http.Request, status int, header http.Header) bool {
+	h.RLock()
+	enabled := h.edgeCompression
+	h.RUnlock()
+
+	if !enabled || r.Method == http.MethodHead || !acceptsGzip(r) {
+		return false
+	}
+
+	if status < http.StatusOK || status == http.StatusNoContent || status == http.StatusNotModified || status == http.StatusPartialContent {
+		return false
+	}
+
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil && length < minCompressSize {
+		return false
+	}
+
+	return compressibleType(header.Get("Content-Type"))
+}
+
+// compressResponse sets the headers of a gzipped response, returning the writer used for the body
+func compressResponse(w http.ResponseWriter) io.WriteCloser {
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	return gzip.NewWriter(w)
+}
+
+// acceptsGzip checks if a visitor accepts gzip encoded responses
+func acceptsGzip(r *http.Request) bool {
+	for _, value := range r.Header.Values("Accept-Encoding") {
+		for _, encoding := range strings.Split(value, ",") {
+			parts := strings.SplitN(encoding, ";", 2)
+
+			if strings.TrimSpace(parts[0]) != "gzip" {
+				continue
+			}
+
+			// gzip;q=0 explicitly refuses gzip
+			return len(parts) == 1 || strings.ReplaceAll(parts[1], " ", "") != "q=0"
+		}
+	}
+
+	return false
+}
+
+// compressibleType checks if a content type is text based. Event streams aren't compressed, as they must be flushed.
+func compressibleType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	if err != nil {
+		return false
+	}
+
+	if mediaType == "text/event-stream" {
+		return false
+	}
+
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml", "application/xhtml+xml",
+		"application/rss+xml", "application/atom+xml", "application/wasm", "image/svg+xml":
+		return true
+	}
+
+	return strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"gogrok.ccatss.dev/server/store"
+	"strings"
+	"time"
+)
+
+var (
+	ErrListUnsupported = errors.New("store does not support listing hosts")
+)
+
+// WithHostExpiry expires registered hosts which haven't been used for ttl.
+// Owners are warned when connecting during the warning period before expiry.
+func WithHostExpiry(ttl, warning time.Duration) HandlerOption {
+	return func(h *ForwardedHTTPHandler) {
+		h.hostTTL = ttl
+		h.hostTTLWarning = warning
+	}
+}
+
+// WithPinnedHosts sets hosts which never expire, in addition to hosts pinned in the store
+func WithPinnedHosts(hosts []string) HandlerOption {
+	return func(h *ForwardedHTTPHandler) {
+		h.pinned = make(map[string]bool)
+
+		for _, host := range hosts {
+			h.pinned[strings.ToLower(host)] = true
+		}
+	}
+}
+
+// isPinned checks if a host is exempt from expiry
+func (h *ForwardedHTTPHandler) isPinned(host store.Host) bool {
+	h.RLock()
+	defer h.RUnlock()
+
+	return host.Pinned || h.pinned[host.Host]
+}
+
+// ownedHosts lists the hosts in the store owned by key
+func (h *ForwardedHTTPHandler) ownedHosts(key string) ([]store.Host, error) {
+	lister, ok := h.store.(store.Lister)
+
+	if !ok {
+		return nil, ErrListUnsupported
+	}
+
+	hosts, err := lister.List()
+
+	if err != nil {
+		return nil, err
+	}
+
+	owned := make([]store.Host, 0)
+
+	for _, host := range hosts {
+		if host.IsOwner(key) {
+			owned = append(owned, host)
+		}
+	}
+
+	return owned, nil
+}
+
+// expiryNotice builds a warning for hosts owned by key which will soon expire
+func (h *ForwardedHTTPHandler) expiryNotice(key string) string {
+	if h.hostTTL <= 0 || h.store == nil {
+		return ""
+	}
+
+	hosts, err := h.ownedHosts(key)
+
+	if err != nil {
+		return ""
+	}
+
+	warnings := make([]string, 0)
+
+	for _, host := range hosts {
+		if h.isPinned(host) {
+			continue
+		}
+
+		expires := host.LastUse.Add(h.hostTTL)
+
+		if time.Until(expires) <= h.hostTTLWarning {
+			warnings = append(warnings, fmt.Sprintf("host %s is unused and will expire on %s", host.Host, expires.Format(time.RFC1123)))
+		}
+	}
+
+	return strings.Join(warnings, "\n")
+}
+
+// ExpireHosts removes registered hosts which haven't been used within the host ttl.
+// Hosts which are currently forwarded have their last use time refreshed instead.
+func (h *ForwardedHTTPHandler) ExpireHosts() (int, error) {
+	lister, ok := h.store.(store.Lister)
+
+	if !ok {
+		return 0, ErrListUnsupported
+	}
+
+	hosts, err := lister.List()
+
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+
+	for _, host := range hosts {
+		if h.isPinned(host) {
+			continue
+		}
+
+		if h.isOnline(host.Host) {
+			if err := store.Touch(h.store, host.Host, time.Now()); err != nil && err != store.ErrNoHost {
+				log.WithError(err).WithField("host", host.Host).Warning("Unable to update host last use")
+			}
+
+			continue
+		}
+
+		if time.Since(host.LastUse) < h.hostTTL {
+			continue
+		}
+
+		// The host may have been used since it was listed, so it's checked again as it's removed
+		expired, err := store.Expire(h.store, host.Host, time.Now().Add(-h.hostTTL))
+
+		if err != nil {
+			return removed, err
+		}
+
+		if !expired {
+			continue
+		}
+
+		log.WithFields(log.Fields{
+			"host":    host.Host,
+			"lastUse": host.LastUse,
+		}).Info("Expired unused host")
+
+		removed++
+	}
+
+	return removed, nil
+}
+
+// isOnline checks if a host, or any host covered by a wildcard host, is currently forwarded
+func (h *ForwardedHTTPHandler) isOnline(host string) bool {
+	h.RLock()
+	defer h.RUnlock()
+
+	if _, exists := h.forwards[host]; exists {
+		return true
+	}
+
+	if IsWildcard(host) {
+		for forwardedHost := range h.forwards {
+			if MatchesWildcard(host, forwardedHost) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// RunReaper periodically expires unused hosts until ctx is done
+func (h *ForwardedHTTPHandler) RunReaper(ctx context.Context, interval time.Duration) {
+	if h.hostTTL <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := h.ExpireHosts(); err != nil {
+			log.WithError(err).Warning("Unable to expire hosts")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ParseTrustedProxies parses a list of proxy addresses and CIDR ranges
+func ParseTrustedProxies(proxies []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(proxies))
+
+	for _, proxy := range proxies {
+		proxy = strings.TrimSpace(proxy)
+
+		if proxy == "" {
+			continue
+		}
+
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", proxy)
+			}
+
+			bits := 8 * net.IPv6len
+
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(proxy)
+
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", proxy, err)
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+// WithTrustedProxies trusts the forwarding headers of requests from proxies (for example Caddy in front of gogrok).
+// Forwarding headers from other addresses are replaced.
+func WithTrustedProxies(proxies []*net.IPNet) HandlerOption {
+	return func(h *ForwardedHTTPHandler) {
+		h.trustedProxies = proxies
+	}
+}
+
+// isTrustedProxy checks if ip is a trusted proxy
+func (h *ForwardedHTTPHandler) isTrustedProxy(ip string) bool {
+	parsedIP := net.ParseIP(ip)
+
+	if parsedIP == nil {
+		return false
+	}
+
+	h.RLock()
+	defer h.RUnlock()
+
+	for _, ipNet := range h.trustedProxies {
+		if ipNet.Contains(parsedIP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// setForwardedHeaders sets X-Forwarded-For, X-Forwarded-Proto, X-Forwarded-Host and Forwarded (RFC 7239) on a request
+// before it's passed to the client, returning the visitor address.
+// Existing headers are extended when the request comes from a trusted proxy, and replaced otherwise.
+func (h *ForwardedHTTPHandler) setForwardedHeaders(r *http.Request) string {
+	remoteIP := remoteIP(r)
+
+	proto := "http"
+
+	if r.TLS != nil {
+		proto = "https"
+	} else if clusterProto, ok := r.Context().Value(clusterContextKey{}).(string); ok {
+		// Requests proxied from another node use the scheme the visitor connected to it with
+		proto = clusterProto
+	}
+
+	host := r.Host
+	clientAddr := r.RemoteAddr
+
+	if h.isTrustedProxy(remoteIP) {
+		// Only known schemes are accepted, as the value is passed on unquoted in Forwarded
+		switch forwardedProto := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto"))); forwardedProto {
+		case "http", "https":
+			proto = forwardedProto
+		}
+
+		if forwardedHost := r.Header.Get("X-Forwarded-Host"); forwardedHost != "" {
+			host = forwardedHost
+		}
+
+		if ip := h.visitorIP(r.Header.Values("X-Forwarded-For")); ip != "" {
+			clientAddr = net.JoinHostPort(ip, "0")
+		}
+	} else {
+		r.Header.Del("X-Forwarded-For")
+		r.Header.Del("X-Forwarded-Proto")
+		r.Header.Del("X-Forwarded-Host")
+		r.Header.Del("Forwarded")
+	}
+
+	if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		r.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+remoteIP)
+	} else {
+		r.Header.Set("X-Forwarded-For", remoteIP)
+	}
+
+	r.Header.Set("X-Forwarded-Proto", proto)
+	r.Header.Set("X-Forwarded-Host", host)
+
+	forwarded := fmt.Sprintf("for=%s;host=%s;proto=%s", forwardedNode(remoteIP), quoteForwarded(host), proto)
+
+	if prior := r.Header.Values("Forwarded"); len(prior) > 0 {
+		forwarded = strings.Join(prior, ", ") + ", " + forwarded
+	}
+
+	r.Header.Set("Forwarded", forwarded)
+
+	return clientAddr
+}
+
+// remoteIP returns the ip address of the connection a request was received on
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
+
+// visitorIP returns the last address in X-Forwarded-For which isn't a trusted proxy
+func (h *ForwardedHTTPHandler) visitorIP(values []string) string {
+	addresses := strings.Split(strings.Join(values, ","), ",")
+
+	for i := len(addresses) - 1; i >= 0; i-- {
+		ip := strings.TrimSpace(addresses[i])
+
+		if net.ParseIP(ip) == nil {
+			return ""
+		}
+
+		if !h.isTrustedProxy(ip) || i == 0 {
+			return ip
+		}
+	}
+
+	return ""
+}
+
+// forwardedNode formats an address as a Forwarded node, quoting IPv6 addresses
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "\"[" + ip + "]\""
+	}
+
+	return ip
+}
+
+// quoteForwarded quotes a Forwarded value if it isn't a valid token (for example a host with a port)
+func quoteForwarded(value string) string {
+	for _, c := range value {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("!#$%&'*+-.^_`|~", c)) {
+			return "\"" + strings.ReplaceAll(value, "\"", "\\\"") + "\""
+		}
+	}
+
+	return value
+}
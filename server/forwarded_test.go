@@ -0,0 +1,146 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSetForwardedHeaders(t *testing.T) {
+	trustedProxies, err := ParseTrustedProxies([]string{"10.0.0.0/8", "192.0.2.1"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &ForwardedHTTPHandler{trustedProxies: trustedProxies}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string]string
+
+		clientAddr string
+		expected   map[string]string
+	}{
+		{
+			name:       "untrusted headers are replaced",
+			remoteAddr: "203.0.113.5:1234",
+			headers: map[string]string{
+				"X-Forwarded-For":   "1.2.3.4",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "evil.example.com",
+				"Forwarded":         "for=1.2.3.4",
+			},
+			clientAddr: "203.0.113.5:1234",
+			expected: map[string]string{
+				"X-Forwarded-For":   "203.0.113.5",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "app.example.com",
+				"Forwarded":         "for=203.0.113.5;host=app.example.com;proto=http",
+			},
+		},
+		{
+			name:       "trusted headers are extended",
+			remoteAddr: "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-For":   "198.51.100.7",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "public.example.com",
+				"Forwarded":         "for=198.51.100.7",
+			},
+			clientAddr: "198.51.100.7:0",
+			expected: map[string]string{
+				"X-Forwarded-For":   "198.51.100.7, 10.0.0.1",
+				"X-Forwarded-Proto": "https",
+				"X-Forwarded-Host":  "public.example.com",
+				"Forwarded":         "for=198.51.100.7, for=10.0.0.1;host=public.example.com;proto=https",
+			},
+		},
+		{
+			name:       "trusted proxy chain",
+			remoteAddr: "192.0.2.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-For": "1.2.3.4, 198.51.100.7, 10.0.0.2",
+			},
+			clientAddr: "198.51.100.7:0",
+			expected: map[string]string{
+				"X-Forwarded-For":   "1.2.3.4, 198.51.100.7, 10.0.0.2, 192.0.2.1",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "app.example.com",
+			},
+		},
+		{
+			name:       "trusted proxy with unknown scheme",
+			remoteAddr: "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-Proto": "https;for=1.2.3.4",
+			},
+			clientAddr: "10.0.0.1:1234",
+			expected: map[string]string{
+				"X-Forwarded-Proto": "http",
+				"Forwarded":         "for=10.0.0.1;host=app.example.com;proto=http",
+			},
+		},
+		{
+			name:       "trusted proxy scheme is normalized",
+			remoteAddr: "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-Proto": " HTTPS ",
+			},
+			clientAddr: "10.0.0.1:1234",
+			expected: map[string]string{
+				"X-Forwarded-Proto": "https",
+			},
+		},
+		{
+			name:       "trusted proxy without headers",
+			remoteAddr: "10.0.0.1:1234",
+			clientAddr: "10.0.0.1:1234",
+			expected: map[string]string{
+				"X-Forwarded-For":   "10.0.0.1",
+				"X-Forwarded-Proto": "http",
+				"X-Forwarded-Host":  "app.example.com",
+				"Forwarded":         "for=10.0.0.1;host=app.example.com;proto=http",
+			},
+		},
+		{
+			name:       "invalid forwarded address",
+			remoteAddr: "10.0.0.1:1234",
+			headers: map[string]string{
+				"X-Forwarded-For": "unknown",
+			},
+			clientAddr: "10.0.0.1:1234",
+			expected: map[string]string{
+				"X-Forwarded-For": "unknown, 10.0.0.1",
+			},
+		},
+		{
+			name:       "ipv6 visitor",
+			remoteAddr: "[2001:db8::1]:1234",
+			clientAddr: "[2001:db8::1]:1234",
+			expected: map[string]string{
+				"X-Forwarded-For": "2001:db8::1",
+				"Forwarded":       "for=\"[2001:db8::1]\";host=app.example.com;proto=http",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		r.RemoteAddr = test.remoteAddr
+
+		for name, value := range test.headers {
+			r.Header.Set(name, value)
+		}
+
+		if clientAddr := h.setForwardedHeaders(r); clientAddr != test.clientAddr {
+			t.Errorf("%s: setForwardedHeaders() = %q, expected %q", test.name, clientAddr, test.clientAddr)
+		}
+
+		for name, expected := range test.expected {
+			if value := r.Header.Get(name); value != expected {
+				t.Errorf("%s: %s = %q, expected %q", test.name, name, value, expected)
+			}
+		}
+	}
+}
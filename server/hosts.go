@@ -1,10 +1,9 @@
 package server
 
 import (
-	"bufio"
-	"bytes"
 	_ "embed"
 	"math/rand"
+	"path"
 	"strings"
 	"time"
 )
@@ -16,24 +15,12 @@ var (
 )
 
 func init() {
-	animals = make([]string, 0)
-
-	s := bufio.NewScanner(bytes.NewReader(animalBytes))
-
-	for s.Scan() {
-		line := strings.TrimSpace(s.Text())
-
-		if line[0] == '#' {
-			continue
-
-		}
-		animals = append(animals, line)
-	}
+	animals = parseWordList(animalBytes)
 
 	rand.Seed(time.Now().UTC().UnixNano())
 }
 
-// RandomAnimal is a basic HostProvider using animal names
+// RandomAnimal returns a random animal name, used as the default HostProvider
 func RandomAnimal() string {
 	return animals[rand.Intn(len(animals))]
 }
@@ -43,6 +30,69 @@ func Animals() []string {
 	return animals
 }
 
+// IsWildcard checks if host is a wildcard host (*.example.com)
+func IsWildcard(host string) bool {
+	return strings.HasPrefix(host, "*.")
+}
+
+// MatchesWildcard checks if host is a direct subdomain of a wildcard host
+func MatchesWildcard(wildcard, host string) bool {
+	if !IsWildcard(wildcard) {
+		return false
+	}
+
+	idx := strings.Index(host, ".")
+
+	return idx > 0 && host[idx:] == wildcard[1:]
+}
+
+// MatchesHostPattern checks host against a host pattern.
+// Wildcards in a pattern match within a single label, so *.example.com only matches direct subdomains,
+// and a pattern of * matches any host.
+func MatchesHostPattern(pattern, host string) bool {
+	if pattern == "*" || pattern == host {
+		return true
+	}
+
+	patternLabels := strings.Split(pattern, ".")
+	hostLabels := strings.Split(host, ".")
+
+	if len(patternLabels) != len(hostLabels) {
+		return false
+	}
+
+	for i, label := range patternLabels {
+		if matched, _ := path.Match(label, hostLabels[i]); !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsDomainName checks if host is a valid fully qualified domain name, optionally a wildcard
+func IsDomainName(host string) bool {
+	labels := strings.Split(strings.TrimPrefix(host, "*."), ".")
+
+	if len(labels) < 2 || len(host) > 253 {
+		return false
+	}
+
+	for _, label := range labels {
+		if len(label) < 1 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
 // DenyAll is a HostValidator to deny all custom requests
 func DenyAll(host string) bool {
 	return false
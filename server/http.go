@@ -3,8 +3,11 @@ package server
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"github.com/gliderlabs/ssh"
 	log "github.com/sirupsen/logrus"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
 	"gogrok.ccatss.dev/common"
 	"gogrok.ccatss.dev/server/store"
 	gossh "golang.org/x/crypto/ssh"
@@ -15,12 +18,18 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // HostProvider is a func to provide a host + subdomain
 type HostProvider func() string
 
+// KeyedHostProvider is a func to provide a host + subdomain for a client's marshalled public key.
+// attempt starts at 0, and is incremented each time a provided host is already in use.
+// An empty string can be returned to skip an attempt.
+type KeyedHostProvider func(key string, attempt int) string
+
 // HostValidator validates hosts (for example, on a subdomain)
 type HostValidator func(host string) bool
 
@@ -28,17 +37,65 @@ type HostValidator func(host string) bool
 // adding the HandleSSHRequest callback to the server's RequestHandlers under
 // tcpip-forward and cancel-tcpip-forward.
 type ForwardedHTTPHandler struct {
-	forwards  map[string]*Forward
-	provider  HostProvider
+	forwards  map[string]*forwardPool
+	provider  KeyedHostProvider
 	validator HostValidator
 	store     store.Store
+	quota     QuotaProvider
+	usage     *usageMeter
+	resolver  TXTResolver
+	cluster   *Cluster
+	pages     *Pages
+	landing   map[string]bool
+
+	trustedProxies []*net.IPNet
+
+	compression     []string
+	edgeCompression bool
+
+	hostTTL        time.Duration
+	hostTTLWarning time.Duration
+	pinned         map[string]bool
+
 	sync.RWMutex
 }
 
 // Forward contains the forwarded connection
 type Forward struct {
+	// bytesIn, bytesOut and inFlight are accessed atomically and kept first for 64-bit alignment
+	bytesIn   uint64
+	bytesOut  uint64
+	inFlight  int64
+	unhealthy int32
+
 	Conn *gossh.ServerConn
 	Key  ssh.PublicKey
+
+	id          string
+	compression string
+	connected   time.Time
+	extensions  bool
+}
+
+// BytesIn returns the number of bytes sent from visitors through this forward
+func (f *Forward) BytesIn() uint64 {
+	return atomic.LoadUint64(&f.bytesIn)
+}
+
+// BytesOut returns the number of bytes returned to visitors through this forward
+func (f *Forward) BytesOut() uint64 {
+	return atomic.LoadUint64(&f.bytesOut)
+}
+
+// Healthy checks if the client last reported its backend as healthy.
+// Forwards are healthy until the client reports otherwise.
+func (f *Forward) Healthy() bool {
+	return atomic.LoadInt32(&f.unhealthy) == 0
+}
+
+// InFlight returns the number of requests currently being served by this forward
+func (f *Forward) InFlight() int64 {
+	return atomic.LoadInt64(&f.inFlight)
 }
 
 // HandlerOption represents a func used to assign options to a ForwardedHTTPHandler
@@ -46,6 +103,13 @@ type HandlerOption func(h *ForwardedHTTPHandler)
 
 // WithProvider sets a default domain provider
 func WithProvider(provider HostProvider) HandlerOption {
+	return func(h *ForwardedHTTPHandler) {
+		h.provider = keyedProvider(provider)
+	}
+}
+
+// WithKeyedProvider sets a default domain provider which is passed the client's key
+func WithKeyedProvider(provider KeyedHostProvider) HandlerOption {
 	return func(h *ForwardedHTTPHandler) {
 		h.provider = provider
 	}
@@ -65,20 +129,57 @@ func WithStore(s store.Store) HandlerOption {
 	}
 }
 
-func NewHttpHandler(opts ...HandlerOption) ForwardHandler {
+// WithQuotaProvider sets the bandwidth quotas applied to each key.
+// Usage is metered by the node a tunnel is connected to, so in a cluster each node enforces quotas separately.
+func WithQuotaProvider(provider QuotaProvider) HandlerOption {
+	return func(h *ForwardedHTTPHandler) {
+		h.quota = provider
+	}
+}
+
+func NewHttpHandler(opts ...HandlerOption) *ForwardedHTTPHandler {
 	h := &ForwardedHTTPHandler{
-		forwards:  make(map[string]*Forward),
-		provider:  RandomAnimal,
+		forwards:  make(map[string]*forwardPool),
+		provider:  keyedProvider(RandomAnimal),
 		validator: DenyAll,
+		quota:     Unlimited,
+
+		compression: common.SupportedCompression(),
 	}
 
 	for _, opt := range opts {
 		opt(h)
 	}
 
+	if h.pages == nil {
+		h.pages = defaultPages()
+	}
+
+	h.usage = newUsageMeter(h.store)
+
 	return h
 }
 
+// Configure applies options at runtime, for example to reload domains, validators or quotas.
+// Options which replace the store or cluster should only be used with NewHttpHandler.
+func (h *ForwardedHTTPHandler) Configure(opts ...HandlerOption) {
+	h.Lock()
+	defer h.Unlock()
+
+	for _, opt := range opts {
+		opt(h)
+	}
+}
+
+// quotaFor returns the quota of key
+func (h *ForwardedHTTPHandler) quotaFor(key string) Quota {
+	h.RLock()
+	quota := h.quota
+	h.RUnlock()
+
+	return quota(key)
+}
+
 // RequestTypes lets the server know which request types this handler can use
 func (h *ForwardedHTTPHandler) RequestTypes() []string {
 	return []string{
@@ -86,31 +187,89 @@ func (h *ForwardedHTTPHandler) RequestTypes() []string {
 		common.CancelHttpForward,
 		common.HttpRegisterHost,
 		common.HttpUnregisterHost,
+		common.HttpUsage,
+		common.HttpTransferHost,
+		common.HttpAddOwner,
+		common.HttpRemoveOwner,
+		common.HttpHealth,
+		common.HttpListHosts,
 	}
 }
 
 // ServeHTTP mocks an http server endpoint that uses Request.Host to forward requests
-func (h *ForwardedHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (h *ForwardedHTTPHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w := &statusWriter{ResponseWriter: rw}
+
+	r, span := h.startRequest(w, r)
+
+	defer func() {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(w.status))
+		span.SetStatus(semconv.SpanStatusFromHTTPStatusCodeAndSpanKind(w.status, trace.SpanKindServer))
+		span.End()
+	}()
+
 	h.RLock()
-	fw, ok := h.forwards[r.Host]
+	pool, ok := h.forwards[r.Host]
 	h.RUnlock()
 
+	// Requests proxied from another node are always served locally
+	if !ok && h.cluster != nil && r.Context().Value(clusterContextKey{}) == nil {
+		if node, exists := h.cluster.Lookup(r.Host); exists {
+			h.cluster.proxy(w, r, node)
+			return
+		}
+	}
+
 	if !ok {
-		log.Warning("Unknown host ", r.Host)
-		http.Error(w, "not found", http.StatusNotFound)
-		log.Println("Valid hosts:", h.forwards)
+		h.serveMissingHost(w, r)
 		return
 	}
 
-	payload := gossh.Marshal(&common.RemoteForwardChannelData{
+	clientAddr := h.setForwardedHeaders(r)
+
+	fw := pool.pick(r, clientAddr)
+
+	if fw == nil {
+		log.WithField("host", r.Host).Debug("No healthy forwards")
+		h.renderPage(w, r, PageBackendUnhealthy)
+		return
+	}
+
+	key := marshalKey(fw.Key)
+	quota := h.quotaFor(key)
+
+	if h.usage.exceeds(key, quota) {
+		log.WithField("host", r.Host).Warning("Bandwidth quota exceeded")
+		h.renderPage(w, r, PageRateLimited)
+		return
+	}
+
+	atomic.AddInt64(&fw.inFlight, 1)
+	defer atomic.AddInt64(&fw.inFlight, -1)
+
+	channelData := common.RemoteForwardChannelData{
 		Host:     r.Host,
-		ClientIP: r.RemoteAddr,
-	})
+		ClientIP: clientAddr,
+	}
+
+	if fw.extensions {
+		channelData.Extensions = common.MarshalExtensions(common.ChannelDataExtensions{
+			RequestID:   r.Header.Get(common.RequestIDHeader),
+			TraceParent: r.Header.Get("Traceparent"),
+		})
+	}
+
+	payload := gossh.Marshal(&channelData)
+
+	_, channelSpan := tracer.Start(r.Context(), "gogrok.channel.open")
 
 	ch, reqs, err := fw.Conn.OpenChannel(common.ForwardedHTTPChannelType, payload)
 
+	endSpan(channelSpan, err)
+
 	if err != nil {
-		log.WithError(err).Warning("Unable to open ssh connection channel")
+		log.WithError(err).WithField("requestId", r.Header.Get(common.RequestIDHeader)).Warning("Unable to open ssh connection channel")
+		h.renderPage(w, r, PageBackendUnreachable)
 		return
 	}
 
@@ -118,28 +277,58 @@ func (h *ForwardedHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 
 	defer ch.Close()
 
+	// Transfers are stopped once the quota is used up
+	meter := h.meter(fw, key, quota)
+
+	chWriter := &meteredWriter{w: ch, meter: meter}
+	chReader := &meteredReader{r: ch, meter: meter}
+
+	// Usage is metered on the compressed data
+	var tunnel io.ReadWriter = struct {
+		io.Reader
+		io.Writer
+	}{chReader, chWriter}
+
+	if fw.compression != "" {
+		stream, err := common.CompressStream(struct {
+			io.Reader
+			io.Writer
+			io.Closer
+		}{chReader, chWriter, ch}, fw.compression)
+
+		if err != nil {
+			log.WithError(err).Warning("Unable to compress channel")
+			h.renderPage(w, r, PageBackendUnreachable)
+			return
+		}
+
+		defer stream.Close()
+
+		tunnel = stream
+	}
+
 	// Ensure we have Connection: close, keep alive isn't supported
 	r.Header.Set("Connection", "close")
 
 	// Write the request to our channel
-	r.Write(ch)
+	r.Write(tunnel)
 
 	// Read the response
-	bufReader := bufio.NewReader(ch)
+	bufReader := bufio.NewReader(tunnel)
 
 	tp := textproto.NewReader(bufReader)
 
 	var s string
 	if s, err = tp.ReadLine(); err != nil {
-		w.WriteHeader(http.StatusBadGateway)
+		h.renderPage(w, r, PageBackendUnreachable)
 		return
 	}
 
 	_, responseCodeStr, _, ok := parseResponseLine(s)
 
 	if !ok {
-		w.WriteHeader(http.StatusBadGateway)
 		log.Warning("Backend returned unexpected response line")
+		h.renderPage(w, r, PageBackendUnreachable)
 		return
 	}
 
@@ -159,25 +348,54 @@ func (h *ForwardedHTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request)
 		w.Header()[k] = v
 	}
 
-	// Set our forwarded address
-	forwardedHeader := r.Header.Get("X-Forwarded-For")
+	var body io.Writer = w
 
-	// TODO: Only trust this from trusted sources.
-	if forwardedHeader != "" {
-		forwardedHeader = strings.Join(append([]string{r.RemoteAddr}, strings.Split(",", forwardedHeader)...), ",")
-	} else {
-		forwardedHeader = r.RemoteAddr
+	if h.shouldCompress(r, responseCode, w.Header()) {
+		gz := compressResponse(w)
+		defer gz.Close()
+
+		body = gz
 	}
 
-	w.Header().Set("X-Forwarded-For", forwardedHeader)
+	w.WriteHeader(responseCode)
 
-	if r.TLS != nil {
-		w.Header().Set("X-Forwarded-Proto", "https")
+	if _, err := io.Copy(body, bufReader); errors.Is(err, ErrQuotaExceeded) {
+		log.WithField("host", r.Host).Warning("Bandwidth quota exceeded during response")
 	}
+}
 
-	w.WriteHeader(responseCode)
+// serveMissingHost serves the landing page for root domains, and error pages for hosts without a local forward
+func (h *ForwardedHTTPHandler) serveMissingHost(w http.ResponseWriter, r *http.Request) {
+	host := strings.ToLower(stripPort(r.Host))
+
+	h.RLock()
+	landing := h.landing[host]
+	h.RUnlock()
+
+	if landing {
+		h.renderPage(w, r, PageLanding)
+		return
+	}
+
+	if h.store != nil {
+		if _, err := store.Lookup(h.store, host); err == nil {
+			h.renderPage(w, r, PageTunnelOffline)
+			return
+		}
+	}
+
+	log.WithField("host", r.Host).Debug("Unknown host")
 
-	io.Copy(w, bufReader)
+	h.renderPage(w, r, PageUnknownHost)
+}
+
+// renderPage writes an error or landing page
+func (h *ForwardedHTTPHandler) renderPage(w http.ResponseWriter, r *http.Request, name string) {
+	h.RLock()
+	pages := h.pages
+	h.RUnlock()
+
+	pages.Render(w, r, name)
 }
 
 // parseResponseLine parses "HTTP/1.1 200 OK" into its three parts.
@@ -191,14 +409,30 @@ func parseResponseLine(line string) (httpVersion, responseCode, responseText str
 	return line[:s1], line[s1+1 : s2], line[s2+1:], true
 }
 
+// validateHost validates a host, using the parent domain for wildcard hosts.
+// This prevents wildcards from covering an entire configured domain.
+func (h *ForwardedHTTPHandler) validateHost(host string) bool {
+	host = strings.TrimPrefix(host, "*.")
+
+	if host == "" || strings.Contains(host, "*") {
+		return false
+	}
+
+	h.RLock()
+	validator := h.validator
+	h.RUnlock()
+
+	return validator == nil || validator(host)
+}
+
 func (h *ForwardedHTTPHandler) checkHostOwnership(host, owner string) bool {
-	hostModel, err := h.store.Get(host)
+	hostModel, err := store.Lookup(h.store, host)
 
 	if err != nil {
 		return false
 	}
 
-	return hostModel.Owner == owner
+	return hostModel.IsOwner(owner)
 }
 
 // HandleSSHRequest handles incoming ssh requests.
@@ -207,6 +441,13 @@ func (h *ForwardedHTTPHandler) HandleSSHRequest(ctx ssh.Context, srv *ssh.Server
 
 	log.WithField("type", req.Type).Info("Handling request")
 
+	switch req.Type {
+	case common.HttpRegisterHost, common.HttpUnregisterHost, common.HttpTransferHost, common.HttpAddOwner, common.HttpRemoveOwner, common.HttpListHosts:
+		if h.store == nil {
+			return false, []byte("host registration is not enabled")
+		}
+	}
+
 	switch req.Type {
 	case common.HttpForward:
 		return h.handleForwardRequest(ctx, conn, req)
@@ -216,6 +457,18 @@ func (h *ForwardedHTTPHandler) HandleSSHRequest(ctx ssh.Context, srv *ssh.Server
 		return h.handleRegisterRequest(ctx, conn, req)
 	case common.HttpUnregisterHost:
 		return h.handleUnregisterRequest(ctx, req)
+	case common.HttpUsage:
+		return h.handleUsageRequest(ctx)
+	case common.HttpTransferHost:
+		return h.handleTransferRequest(ctx, req)
+	case common.HttpAddOwner:
+		return h.handleAddOwnerRequest(ctx, req)
+	case common.HttpRemoveOwner:
+		return h.handleRemoveOwnerRequest(ctx, req)
+	case common.HttpHealth:
+		return h.handleHealthRequest(ctx, conn, req)
+	case common.HttpListHosts:
+		return h.handleListHostsRequest(ctx)
 	default:
 		return false, nil
 	}
@@ -228,24 +481,66 @@ func (h *ForwardedHTTPHandler) handleForwardRequest(ctx ssh.Context, conn *gossh
 		return false, []byte{}
 	}
 
+	var ext common.ForwardRequestExtensions
+	if err := common.UnmarshalExtensions(reqPayload.Extensions, &ext); err != nil {
+		log.WithError(err).Warning("Error parsing extensions for http-forward")
+		return false, []byte{}
+	}
+
 	pubKey := ctx.Value("publicKey").(ssh.PublicKey)
 
-	keyStr := string(bytes.TrimSpace(gossh.MarshalAuthorizedKey(pubKey)))
+	keyStr := marshalKey(pubKey)
+
+	if h.usage.exceeds(keyStr, h.quotaFor(keyStr)) {
+		return false, []byte("bandwidth quota exceeded")
+	}
+
+	perms := permissionsFromContext(ctx)
+
+	if h.tunnelLimitReached(perms, keyStr) {
+		return false, []byte("maximum number of tunnels reached")
+	}
 
 	host := strings.ToLower(reqPayload.RequestedHost)
 
+	if ext.Pool != "" {
+		if !ValidPoolStrategy(ext.Pool) {
+			return false, []byte("unknown pool strategy " + ext.Pool)
+		}
+
+		if host == "" {
+			return false, []byte("pool mode requires a registered host")
+		}
+	}
+
+	if host != "" && !hostAllowed(ctx, host) {
+		return false, []byte("host " + host + " is not allowed for this key")
+	}
+
+	if host == "" && !perms.AllowsRandom() {
+		return false, []byte("random hosts are not allowed for this key")
+	}
+
 	if host != "" {
-		if h.validator != nil && !h.validator(host) {
+		if IsWildcard(host) {
+			return false, []byte("wildcard hosts cannot be forwarded directly")
+		}
+
+		if !h.validateHost(host) && !h.isCustomHost(host) {
 			return false, []byte("invalid host " + host)
 		}
 
-		hostModel, err := h.store.Get(host)
+		if h.store == nil {
+			return false, []byte("host registration is not enabled")
+		}
+
+		hostModel, err := store.Lookup(h.store, host)
 
 		if hostModel == nil || err != nil {
 			return false, []byte("host not registered")
 		}
 
-		if hostModel.Owner != keyStr {
+		if !hostModel.IsOwner(keyStr) {
 			return false, []byte("host claimed and not owned by current key")
 		}
 
@@ -253,61 +548,120 @@ func (h *ForwardedHTTPHandler) handleForwardRequest(ctx ssh.Context, conn *gossh
 		current, exists := h.forwards[host]
 		h.RUnlock()
 
-		if exists && !reqPayload.Force {
-			return false, []byte("host already in use and force not set")
+		if h.cluster != nil {
+			if _, remote := h.cluster.Lookup(host); remote {
+				return false, []byte("host already in use on another node")
+			}
 		}
 
-		if exists {
-			// Force old connection to close
-			current.Conn.Close()
+		joining := exists && ext.Pool != "" && current.strategy == ext.Pool
+
+		if exists && !joining && !reqPayload.Force {
+			if current.pooled() && ext.Pool != "" {
+				return false, []byte("host already pooled using " + current.strategy + " and force not set")
+			}
+
+			return false, []byte("host already in use and force not set")
 		}
 
-		hostModel.LastUse = time.Now()
+		if exists && !joining {
+			// Force old connections to close
+			for _, fw := range current.forwards() {
+				fw.Conn.Close()
+			}
+		}
 
 		// Save model last use time
-		h.store.Add(*hostModel)
+		store.Touch(h.store, hostModel.Host, time.Now())
 	} else {
-		host = h.provider()
-	}
+		randomHost, err := h.randomHost(keyStr)
 
-	// Validate host
-	if host == "" {
-		h.RLock()
-		for {
-			host = h.provider()
+		if err != nil {
+			log.WithError(err).Warning("Unable to provide a random host")
+			return false, []byte(err.Error())
+		}
 
-			_, exists := h.forwards[host]
+		host = randomHost
+	}
 
-			if !exists {
-				break
-			}
-		}
-		h.RUnlock()
+	// Random hosts must still match the hosts permitted by the policy and authorized_keys options
+	if reqPayload.RequestedHost == "" && !hostAllowed(ctx, host) {
+		return false, []byte("random hosts are not allowed for this key")
 	}
 
 	log.WithField("host", host).Info("Registering host")
 
+	h.RLock()
+	compression := common.NegotiateCompression(ext.Compression, h.compression)
+	h.RUnlock()
+
+	fw := &Forward{
+		Conn:        conn,
+		Key:         pubKey,
+		id:          forwardID(conn.SessionID()),
+		compression: compression,
+		connected:   time.Now(),
+		extensions:  extensionsEnabled(ctx),
+	}
+
 	h.Lock()
-	h.forwards[host] = &Forward{
-		Conn: conn,
-		Key:  pubKey,
+
+	// Checked again under the lock the forward is added with, so concurrent requests can't exceed the limit
+	if perms != nil && perms.MaxTunnels > 0 && h.countForwards(keyStr) >= perms.MaxTunnels {
+		h.Unlock()
+		return false, []byte("maximum number of tunnels reached")
 	}
+
+	pool, exists := h.forwards[host]
+
+	// Another client may have been given the same random host since it was checked
+	if exists && reqPayload.RequestedHost == "" {
+		h.Unlock()
+		return false, []byte("random host already in use, try again")
+	}
+
+	// Closed connections are removed asynchronously, so a forced host may still hold its previous pool
+	if !exists || !pool.pooled() || pool.strategy != ext.Pool {
+		pool = newForwardPool(ext.Pool, ext.PoolCookie)
+		h.forwards[host] = pool
+	}
+
+	pool.add(fw)
 	h.Unlock()
 
-	log.WithField("host", host).Info("Registered host")
+	if h.cluster != nil {
+		h.cluster.Announce(host)
+	}
+
+	log.WithFields(log.Fields{
+		"host":        host,
+		"pool":        ext.Pool,
+		"compression": compression,
+	}).Info("Registered host")
 
 	go func() {
 		<-ctx.Done()
 
-		log.WithField("host", host).Info("Removed host")
-		h.Lock()
-		delete(h.forwards, host)
-		h.Unlock()
+		log.WithFields(log.Fields{
+			"host":     host,
+			"bytesIn":  fw.BytesIn(),
+			"bytesOut": fw.BytesOut(),
+		}).Info("Removed host")
+		h.removeForward(host, fw)
 	}()
 
-	return true, gossh.Marshal(&common.RemoteForwardSuccess{
+	success := common.RemoteForwardSuccess{
 		Host: host,
-	})
+	}
+
+	if extensionsEnabled(ctx) {
+		success.Extensions = common.MarshalExtensions(common.ForwardSuccessExtensions{
+			Notice:      h.expiryNotice(keyStr),
+			Compression: compression,
+		})
+	}
+
+	return true, gossh.Marshal(&success)
 }
 
 func (h *ForwardedHTTPHandler) handleCancelRequest(ctx ssh.Context, req *gossh.Request) (bool, []byte) {
@@ -318,27 +672,133 @@ func (h *ForwardedHTTPHandler) handleCancelRequest(ctx ssh.Context, req *gossh.R
 	}
 
 	pubKey := ctx.Value("publicKey").(ssh.PublicKey)
+	conn := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
 
 	host := strings.ToLower(reqPayload.Host)
 
 	h.RLock()
-	fw, exists := h.forwards[host]
+	pool, exists := h.forwards[host]
 	h.RUnlock()
 
 	if !exists {
 		return false, []byte("host not found")
 	}
 
-	if !bytes.Equal(pubKey.Marshal(), fw.Key.Marshal()) {
+	// Prefer the forward of the requesting connection, so one member of a pool doesn't remove another
+	var fw *Forward
+
+	for _, member := range pool.forwards() {
+		if member.Conn == conn {
+			fw = member
+			break
+		}
+
+		if fw == nil && bytes.Equal(pubKey.Marshal(), member.Key.Marshal()) {
+			fw = member
+		}
+	}
+
+	if fw == nil {
 		return false, []byte("host not owned by key")
 	}
 
 	log.WithField("host", host).Info("Unregistering host")
 
+	h.removeForward(host, fw)
+	return true, nil
+}
+
+// handleHealthRequest marks the forward of a host on the requesting connection as healthy or unhealthy
+func (h *ForwardedHTTPHandler) handleHealthRequest(ctx ssh.Context, conn *gossh.ServerConn, req *gossh.Request) (bool, []byte) {
+	var reqPayload common.HealthReport
+	if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+		log.WithError(err).Warning("Error parsing payload for http-health")
+		return false, []byte{}
+	}
+
+	host := strings.ToLower(reqPayload.Host)
+
+	h.RLock()
+	pool, exists := h.forwards[host]
+	h.RUnlock()
+
+	if !exists {
+		return false, []byte("host not found")
+	}
+
+	for _, fw := range pool.forwards() {
+		if fw.Conn != conn {
+			continue
+		}
+
+		var unhealthy int32
+
+		if !reqPayload.Healthy {
+			unhealthy = 1
+		}
+
+		if atomic.SwapInt32(&fw.unhealthy, unhealthy) != unhealthy {
+			log.WithFields(log.Fields{
+				"host":    host,
+				"healthy": reqPayload.Healthy,
+				"message": reqPayload.Message,
+			}).Info("Forward health changed")
+		}
+
+		return true, nil
+	}
+
+	return false, []byte("host not forwarded by this connection")
+}
+
+// tunnelLimitReached checks if a key has as many forwards as its permissions allow
+func (h *ForwardedHTTPHandler) tunnelLimitReached(perms *Permissions, key string) bool {
+	if perms == nil || perms.MaxTunnels <= 0 {
+		return false
+	}
+
+	h.RLock()
+	defer h.RUnlock()
+
+	return h.countForwards(key) >= perms.MaxTunnels
+}
+
+// countForwards counts the forwards of a key, h must be locked
+func (h *ForwardedHTTPHandler) countForwards(key string) int {
+	count := 0
+
+	for _, pool := range h.forwards {
+		for _, fw := range pool.forwards() {
+			if marshalKey(fw.Key) == key {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+// removeForward removes fw from host's pool, removing the host once no forwards remain
+func (h *ForwardedHTTPHandler) removeForward(host string, fw *Forward) {
 	h.Lock()
+	pool, exists := h.forwards[host]
+
+	if !exists {
+		h.Unlock()
+		return
+	}
+
+	if remaining, removed := pool.remove(fw); !removed || remaining > 0 {
+		h.Unlock()
+		return
+	}
+
 	delete(h.forwards, host)
 	h.Unlock()
-	return true, nil
+
+	if h.cluster != nil {
+		h.cluster.Withdraw(host)
+	}
 }
 
 func (h *ForwardedHTTPHandler) handleRegisterRequest(ctx ssh.Context, conn *gossh.ServerConn, req *gossh.Request) (bool, []byte) {
@@ -350,11 +810,34 @@ func (h *ForwardedHTTPHandler) handleRegisterRequest(ctx ssh.Context, conn *goss
 
 	pubKey := ctx.Value("publicKey").(ssh.PublicKey)
 
-	keyStr := string(bytes.TrimSpace(gossh.MarshalAuthorizedKey(pubKey)))
+	keyStr := marshalKey(pubKey)
 
 	host := strings.ToLower(reqPayload.Host)
 
-	if host == "" || h.validator != nil && !h.validator(host) {
+	perms := permissionsFromContext(ctx)
+
+	if !hostAllowed(ctx, host) {
+		return false, []byte("host " + host + " is not allowed for this key")
+	}
+
+	if perms != nil && perms.MaxHosts > 0 {
+		owned, err := h.ownedHosts(keyStr)
+
+		if err != nil {
+			log.WithError(err).Warning("Unable to count registered hosts")
+			return false, []byte("unable to check registered host limit")
+		}
+
+		// Co-owned hosts count towards the limit, as co-owners can leave them by unregistering
+		if len(owned) >= perms.MaxHosts {
+			return false, []byte("maximum number of registered hosts reached")
+		}
+	}
+
+	// Hosts outside of the validator's domains require dns verification
+	custom := !h.validateHost(host)
+
+	if custom && (h.resolver == nil || !IsDomainName(host)) {
 		log.WithField("host", host).Warning("Host failed validation")
 		return false, []byte("invalid host " + host)
 	}
@@ -364,25 +847,62 @@ func (h *ForwardedHTTPHandler) handleRegisterRequest(ctx ssh.Context, conn *goss
 		return false, []byte("host is already taken")
 	}
 
+	// Hosts covered by a wildcard may only be registered by the wildcard's owners
+	wildcard, err := store.Lookup(h.store, host)
+
+	if err == nil && !wildcard.IsOwner(keyStr) {
+		log.WithField("host", host).Warning("Host is covered by a wildcard registration")
+		return false, []byte("host is covered by a wildcard registration")
+	}
+
+	// Custom hosts under an owned, verified wildcard don't need to be verified again
+	if custom && (wildcard == nil || !wildcard.Custom) && !h.verifyDomain(host, keyStr) {
+		log.WithField("host", host).Info("Custom host requires verification")
+
+		record, token := ChallengeRecord(host), ChallengeToken(host, keyStr)
+
+		// Clients without extensions can't receive the challenge in the response
+		if !extensionsEnabled(ctx) {
+			return false, []byte("host " + host + " requires verification using a TXT record " + record + " with value " + token)
+		}
+
+		return true, gossh.Marshal(common.HostRegisterSuccess{
+			Host: host,
+			Extensions: common.MarshalExtensions(common.RegisterSuccessExtensions{
+				Record: record,
+				Token:  token,
+			}),
+		})
+	}
+
 	ip, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
 
 	log.WithField("ip", ip).WithField("host", host).Info("Registering host")
 
-	err := h.store.Add(store.Host{
+	err = h.store.Add(store.Host{
 		Host:    host,
 		Owner:   keyStr,
 		IP:      ip,
 		Created: time.Now(),
 		LastUse: time.Now(),
+		Custom:  custom,
 	})
 
 	if err != nil {
 		return false, []byte(err.Error())
 	}
 
-	return true, gossh.Marshal(common.HostRegisterSuccess{
+	success := common.HostRegisterSuccess{
 		Host: host,
-	})
+	}
+
+	if extensionsEnabled(ctx) {
+		success.Extensions = common.MarshalExtensions(common.RegisterSuccessExtensions{
+			Notice: h.expiryNotice(keyStr),
+		})
+	}
+
+	return true, gossh.Marshal(success)
 }
 
 func (h *ForwardedHTTPHandler) handleUnregisterRequest(ctx ssh.Context, req *gossh.Request) (bool, []byte) {
@@ -394,11 +914,11 @@ func (h *ForwardedHTTPHandler) handleUnregisterRequest(ctx ssh.Context, req *gos
 
 	pubKey := ctx.Value("publicKey").(ssh.PublicKey)
 
-	keyStr := string(bytes.TrimSpace(gossh.MarshalAuthorizedKey(pubKey)))
+	keyStr := marshalKey(pubKey)
 
 	host := strings.ToLower(reqPayload.Host)
 
-	if host == "" || h.validator != nil && !h.validator(host) {
+	if !h.validateHost(host) && !h.isCustomHost(host) {
 		return false, []byte("invalid host " + host)
 	}
 
@@ -408,13 +928,51 @@ func (h *ForwardedHTTPHandler) handleUnregisterRequest(ctx ssh.Context, req *gos
 		return false, []byte(err.Error())
 	}
 
-	if hostModel.Owner != keyStr {
+	switch {
+	case hostModel.Owner == keyStr:
+		if err := h.store.Remove(host); err != nil {
+			return false, []byte(err.Error())
+		}
+	case hostModel.IsCoOwner(keyStr):
+		// Co-owners leave the host, which stays registered to its owner
+		hostModel.RemoveCoOwner(keyStr)
+
+		if err := h.store.Add(*hostModel); err != nil {
+			return false, []byte(err.Error())
+		}
+	default:
 		return false, []byte("this host is not owned by you")
 	}
 
-	h.store.Remove(host)
-
 	return true, gossh.Marshal(common.HostRegisterSuccess{
 		Host: host,
 	})
 }
+
+func (h *ForwardedHTTPHandler) handleUsageRequest(ctx ssh.Context) (bool, []byte) {
+	pubKey := ctx.Value("publicKey").(ssh.PublicKey)
+
+	keyStr := marshalKey(pubKey)
+
+	now := time.Now()
+
+	daily := h.usage.get(keyStr, dailyPeriod(now))
+	monthly := h.usage.get(keyStr, monthlyPeriod(now))
+	quota := h.quotaFor(keyStr)
+
+	return true, gossh.Marshal(common.UsageResponse{
+		Day:          daily.Period,
+		DailyIn:      daily.BytesIn,
+		DailyOut:     daily.BytesOut,
+		DailyQuota:   quota.Daily,
+		Month:        monthly.Period,
+		MonthlyIn:    monthly.BytesIn,
+		MonthlyOut:   monthly.BytesOut,
+		MonthlyQuota: quota.Monthly,
+	})
+}
+
+// marshalKey returns the authorized key format of pubKey, used to identify owners
+func marshalKey(pubKey ssh.PublicKey) string {
+	return string(bytes.TrimSpace(gossh.MarshalAuthorizedKey(pubKey)))
+}
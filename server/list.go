@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/gliderlabs/ssh"
+	log "github.com/sirupsen/logrus"
+	"gogrok.ccatss.dev/common"
+	"sort"
+)
+
+// Roles of a key in a HostInfo
+const (
+	roleOwner   = "owner"
+	roleCoOwner = "co-owner"
+)
+
+// handleListHostsRequest returns the hosts owned or co-owned by the requesting key as JSON
+func (h *ForwardedHTTPHandler) handleListHostsRequest(ctx ssh.Context) (bool, []byte) {
+	keyStr := marshalKey(ctx.Value("publicKey").(ssh.PublicKey))
+
+	owned, err := h.ownedHosts(keyStr)
+
+	if err != nil {
+		log.WithError(err).Warning("Unable to list hosts")
+		return false, []byte("unable to list hosts")
+	}
+
+	sort.Slice(owned, func(i, j int) bool {
+		return owned[i].Host < owned[j].Host
+	})
+
+	hosts := make([]common.HostInfo, len(owned))
+
+	for i, host := range owned {
+		role := roleOwner
+
+		if host.Owner != keyStr {
+			role = roleCoOwner
+		}
+
+		hosts[i] = common.HostInfo{
+			Host:    host.Host,
+			Role:    role,
+			Custom:  host.Custom,
+			Online:  h.isOnline(host.Host),
+			Created: host.Created,
+			LastUse: host.LastUse,
+		}
+	}
+
+	b, err := json.Marshal(hosts)
+
+	if err != nil {
+		return false, []byte(err.Error())
+	}
+
+	return true, b
+}
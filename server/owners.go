@@ -0,0 +1,138 @@
+package server
+
+import (
+	"github.com/gliderlabs/ssh"
+	log "github.com/sirupsen/logrus"
+	"gogrok.ccatss.dev/common"
+	gossh "golang.org/x/crypto/ssh"
+	"strings"
+)
+
+// parseOwnerRequest parses a HostOwnerRequest, normalizing the target key
+func parseOwnerRequest(req *gossh.Request) (*common.HostOwnerRequest, error) {
+	var reqPayload common.HostOwnerRequest
+	if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+		return nil, err
+	}
+
+	// Parse and re-serialize the key to support comments/etc
+	targetKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(reqPayload.Key))
+
+	if err != nil {
+		return nil, err
+	}
+
+	reqPayload.Host = strings.ToLower(reqPayload.Host)
+	reqPayload.Key = marshalKey(targetKey)
+
+	return &reqPayload, nil
+}
+
+func (h *ForwardedHTTPHandler) handleTransferRequest(ctx ssh.Context, req *gossh.Request) (bool, []byte) {
+	reqPayload, err := parseOwnerRequest(req)
+
+	if err != nil {
+		log.WithError(err).Warning("Error parsing payload for http-transfer-host")
+		return false, []byte("invalid request")
+	}
+
+	keyStr := marshalKey(ctx.Value("publicKey").(ssh.PublicKey))
+
+	hostModel, err := h.store.Get(reqPayload.Host)
+
+	if hostModel == nil || err != nil {
+		return false, []byte("host not registered")
+	}
+
+	if hostModel.Owner != keyStr {
+		return false, []byte("only the owner can transfer this host")
+	}
+
+	hostModel.Owner = reqPayload.Key
+	hostModel.RemoveCoOwner(reqPayload.Key)
+
+	if err := h.store.Add(*hostModel); err != nil {
+		return false, []byte(err.Error())
+	}
+
+	log.WithField("host", hostModel.Host).Info("Transferred host to new owner")
+
+	return true, gossh.Marshal(common.HostRegisterSuccess{
+		Host: hostModel.Host,
+	})
+}
+
+func (h *ForwardedHTTPHandler) handleAddOwnerRequest(ctx ssh.Context, req *gossh.Request) (bool, []byte) {
+	reqPayload, err := parseOwnerRequest(req)
+
+	if err != nil {
+		log.WithError(err).Warning("Error parsing payload for http-add-owner")
+		return false, []byte("invalid request")
+	}
+
+	keyStr := marshalKey(ctx.Value("publicKey").(ssh.PublicKey))
+
+	hostModel, err := h.store.Get(reqPayload.Host)
+
+	if hostModel == nil || err != nil {
+		return false, []byte("host not registered")
+	}
+
+	if hostModel.Owner != keyStr {
+		return false, []byte("only the owner can add co-owners")
+	}
+
+	if hostModel.IsOwner(reqPayload.Key) {
+		return false, []byte("key already owns this host")
+	}
+
+	hostModel.CoOwners = append(hostModel.CoOwners, reqPayload.Key)
+
+	if err := h.store.Add(*hostModel); err != nil {
+		return false, []byte(err.Error())
+	}
+
+	log.WithField("host", hostModel.Host).Info("Added co-owner to host")
+
+	return true, gossh.Marshal(common.HostRegisterSuccess{
+		Host: hostModel.Host,
+	})
+}
+
+func (h *ForwardedHTTPHandler) handleRemoveOwnerRequest(ctx ssh.Context, req *gossh.Request) (bool, []byte) {
+	reqPayload, err := parseOwnerRequest(req)
+
+	if err != nil {
+		log.WithError(err).Warning("Error parsing payload for http-remove-owner")
+		return false, []byte("invalid request")
+	}
+
+	keyStr := marshalKey(ctx.Value("publicKey").(ssh.PublicKey))
+
+	hostModel, err := h.store.Get(reqPayload.Host)
+
+	if hostModel == nil || err != nil {
+		return false, []byte("host not registered")
+	}
+
+	// Co-owners may remove themselves, only the owner may remove others
+	if hostModel.Owner != keyStr && reqPayload.Key != keyStr {
+		return false, []byte("only the owner can remove co-owners")
+	}
+
+	if !hostModel.IsCoOwner(reqPayload.Key) {
+		return false, []byte("key is not a co-owner of this host")
+	}
+
+	hostModel.RemoveCoOwner(reqPayload.Key)
+
+	if err := h.store.Add(*hostModel); err != nil {
+		return false, []byte(err.Error())
+	}
+
+	log.WithField("host", hostModel.Host).Info("Removed co-owner from host")
+
+	return true, gossh.Marshal(common.HostRegisterSuccess{
+		Host: hostModel.Host,
+	})
+}
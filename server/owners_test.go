@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/gliderlabs/ssh"
+	"gogrok.ccatss.dev/common"
+	"gogrok.ccatss.dev/server/store"
+	gossh "golang.org/x/crypto/ssh"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// testContext is a minimal ssh.Context for calling request handlers directly
+type testContext struct {
+	context.Context
+	sync.Mutex
+}
+
+func newTestContext(key ssh.PublicKey, perms *Permissions) *testContext {
+	ctx := &testContext{Context: context.Background()}
+	ctx.SetValue("publicKey", key)
+	ctx.SetValue("permissions", perms)
+
+	return ctx
+}
+
+func (c *testContext) User() string                  { return "" }
+func (c *testContext) SessionID() string             { return "" }
+func (c *testContext) ClientVersion() string         { return "" }
+func (c *testContext) ServerVersion() string         { return "" }
+func (c *testContext) RemoteAddr() net.Addr          { return nil }
+func (c *testContext) LocalAddr() net.Addr           { return nil }
+func (c *testContext) Permissions() *ssh.Permissions { return nil }
+func (c *testContext) SetValue(key, value interface{}) {
+	c.Context = context.WithValue(c.Context, key, value)
+}
+
+// testKey generates a public key
+func testKey(t *testing.T) ssh.PublicKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := gossh.NewPublicKey(pub)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// hostRequest creates a request for host
+func hostRequest(host string) *gossh.Request {
+	return &gossh.Request{Payload: gossh.Marshal(common.HostRegisterRequest{Host: host})}
+}
+
+func TestCoOwnerRules(t *testing.T) {
+	s, err := store.NewBoltStore(filepath.Join(t.TempDir(), "gogrok.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := NewHttpHandler(WithStore(s), WithValidator(func(host string) bool { return true }))
+
+	owner, coOwner, other := testKey(t), testKey(t), testKey(t)
+
+	for _, host := range []store.Host{
+		{Host: "shared.example.com", Owner: marshalKey(owner), CoOwners: []string{marshalKey(coOwner)}},
+		{Host: "owned.example.com", Owner: marshalKey(coOwner)},
+	} {
+		if err := s.Add(host); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Co-owned hosts count towards the limit
+	ok, reply := h.handleRegisterRequest(newTestContext(coOwner, &Permissions{MaxHosts: 2}), nil, hostRequest("new.example.com"))
+
+	if ok || string(reply) != "maximum number of registered hosts reached" {
+		t.Errorf("register beyond the limit = %v, %q, expected the limit to be reached", ok, reply)
+	}
+
+	ok, reply = h.handleRegisterRequest(newTestContext(coOwner, &Permissions{MaxHosts: 3}), nil, hostRequest("owned.example.com"))
+
+	if ok || string(reply) != "host is already taken" {
+		t.Errorf("register within the limit = %v, %q, expected the host to be taken", ok, reply)
+	}
+
+	if ok, reply := h.handleUnregisterRequest(newTestContext(other, nil), hostRequest("shared.example.com")); ok {
+		t.Errorf("unregister by another key succeeded: %q", reply)
+	}
+
+	// Co-owners leave the host, which stays registered to its owner
+	if ok, reply := h.handleUnregisterRequest(newTestContext(coOwner, nil), hostRequest("shared.example.com")); !ok {
+		t.Fatalf("unregister by co-owner failed: %q", reply)
+	}
+
+	host, err := s.Get("shared.example.com")
+
+	if err != nil {
+		t.Fatalf("host removed by co-owner: %v", err)
+	}
+
+	if host.Owner != marshalKey(owner) || host.IsCoOwner(marshalKey(coOwner)) {
+		t.Errorf("host after co-owner unregister = %+v, expected only the owner", host)
+	}
+
+	if ok, reply := h.handleUnregisterRequest(newTestContext(owner, nil), hostRequest("shared.example.com")); !ok {
+		t.Fatalf("unregister by owner failed: %q", reply)
+	}
+
+	if s.Has("shared.example.com") {
+		t.Error("host still registered after owner unregister")
+	}
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"gogrok.ccatss.dev/common"
+	"html/template"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Page names, also used as template file names (for example tunnel-offline.html)
+const (
+	PageUnknownHost        = "unknown-host"
+	PageTunnelOffline      = "tunnel-offline"
+	PageBackendUnreachable = "backend-unreachable"
+	PageBackendUnhealthy   = "backend-unhealthy"
+	PageRateLimited        = "rate-limited"
+	PageAuthRequired       = "auth-required"
+	PageLanding            = "landing"
+
+	// pageFallback is used for error pages without their own template
+	pageFallback = "error"
+)
+
+var (
+	//go:embed pages/*.html
+	defaultPageFiles embed.FS
+
+	pageNames = []string{
+		PageUnknownHost,
+		PageTunnelOffline,
+		PageBackendUnreachable,
+		PageBackendUnhealthy,
+		PageRateLimited,
+		PageAuthRequired,
+		PageLanding,
+	}
+
+	pageDefaults = map[string]PageData{
+		PageUnknownHost: {
+			Status:  http.StatusNotFound,
+			Title:   "Unknown host",
+			Message: "There is no tunnel for this host.",
+		},
+		PageTunnelOffline: {
+			Status:  http.StatusServiceUnavailable,
+			Title:   "Tunnel offline",
+			Message: "This host is registered, but its tunnel isn't connected right now. Try again later.",
+		},
+		PageBackendUnreachable: {
+			Status:  http.StatusBadGateway,
+			Title:   "Bad gateway",
+			Message: "The tunnel is connected, but the server behind it didn't respond.",
+		},
+		PageBackendUnhealthy: {
+			Status:  http.StatusServiceUnavailable,
+			Title:   "Tunnel backend unhealthy",
+			Message: "The tunnel is connected, but the server behind it is failing its health checks. Try again later.",
+		},
+		PageRateLimited: {
+			Status:  http.StatusTooManyRequests,
+			Title:   "Rate limited",
+			Message: "This tunnel has used its bandwidth quota. Try again later.",
+		},
+		PageAuthRequired: {
+			Status:  http.StatusUnauthorized,
+			Title:   "Authentication required",
+			Message: "You must authenticate to access this resource.",
+		},
+		PageLanding: {
+			Status: http.StatusOK,
+		},
+	}
+)
+
+// PageData is passed to page templates
+type PageData struct {
+	Status  int    `json:"status"`
+	Page    string `json:"error"`
+	Title   string `json:"-"`
+	Message string `json:"message"`
+	Host    string `json:"host,omitempty"`
+
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// Pages renders error and landing pages
+type Pages struct {
+	templates map[string]*template.Template
+}
+
+// NewPages loads page templates from dir, using the built in pages for any templates not in dir.
+// Error pages without their own template use error.html. An empty dir uses only the built in pages.
+func NewPages(dir string) (*Pages, error) {
+	p := &Pages{
+		templates: make(map[string]*template.Template),
+	}
+
+	for _, name := range pageNames {
+		candidates := []string{name}
+
+		if name != PageLanding {
+			candidates = append(candidates, pageFallback)
+		}
+
+		var tpl *template.Template
+
+		for _, candidate := range candidates {
+			var err error
+
+			tpl, err = loadPageTemplate(dir, candidate)
+
+			if err != nil {
+				return nil, err
+			}
+
+			if tpl != nil {
+				break
+			}
+		}
+
+		p.templates[name] = tpl
+	}
+
+	return p, nil
+}
+
+// loadPageTemplate loads a template from dir, then the built in pages, returning nil if neither exist
+func loadPageTemplate(dir, name string) (*template.Template, error) {
+	fileName := name + ".html"
+
+	if dir != "" {
+		path := filepath.Join(dir, fileName)
+
+		if _, err := os.Stat(path); err == nil {
+			return template.ParseFiles(path)
+		}
+	}
+
+	if _, err := defaultPageFiles.Open("pages/" + fileName); err != nil {
+		return nil, nil
+	}
+
+	return template.ParseFS(defaultPageFiles, "pages/"+fileName)
+}
+
+// defaultPages returns the built in pages
+func defaultPages() *Pages {
+	p, err := NewPages("")
+
+	if err != nil {
+		panic(err)
+	}
+
+	return p
+}
+
+// WithPages sets the templates used for error and landing pages
+func WithPages(p *Pages) HandlerOption {
+	return func(h *ForwardedHTTPHandler) {
+		h.pages = p
+	}
+}
+
+// WithLandingPage serves the landing page on the bare root domains (for example example.com for *.example.com)
+func WithLandingPage(domains []string) HandlerOption {
+	return func(h *ForwardedHTTPHandler) {
+		h.landing = make(map[string]bool)
+
+		for _, domain := range domains {
+			h.landing[strings.ToLower(domain)] = true
+		}
+	}
+}
+
+// Render writes a page, as JSON if the request prefers it over HTML
+func (p *Pages) Render(w http.ResponseWriter, r *http.Request, name string) {
+	data := pageDefaults[name]
+	data.Page = name
+	data.Host = stripPort(r.Host)
+	data.RequestID = r.Header.Get(common.RequestIDHeader)
+
+	w.Header().Set("Cache-Control", "no-store")
+
+	if wantsJSON(r) && name != PageLanding {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(data.Status)
+
+		json.NewEncoder(w).Encode(data)
+		return
+	}
+
+	var buf bytes.Buffer
+
+	if tpl := p.templates[name]; tpl != nil {
+		if err := tpl.Execute(&buf, data); err != nil {
+			log.WithError(err).WithField("page", name).Warning("Unable to render page")
+			buf.Reset()
+		}
+	}
+
+	if buf.Len() == 0 {
+		http.Error(w, http.StatusText(data.Status), data.Status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(data.Status)
+
+	w.Write(buf.Bytes())
+}
+
+// acceptRange is a media range from an Accept header, with its quality and position
+type acceptRange struct {
+	mediaType string
+	quality   float64
+	index     int
+}
+
+// wantsJSON checks if the Accept header prefers JSON to HTML.
+// The most specific range matching each type sets its quality, and ties go to the type listed first.
+// HTML is used when neither is acceptable.
+func wantsJSON(r *http.Request) bool {
+	ranges := parseAccept(r.Header.Get("Accept"))
+
+	jsonRange := bestRange(ranges, func(mediaType string) bool {
+		return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+	}, "application/*")
+
+	htmlRange := bestRange(ranges, func(mediaType string) bool {
+		return mediaType == "text/html"
+	}, "text/*")
+
+	if jsonRange == nil || jsonRange.quality == 0 {
+		return false
+	}
+
+	if htmlRange == nil || jsonRange.quality > htmlRange.quality {
+		return true
+	}
+
+	return jsonRange.quality == htmlRange.quality && jsonRange.index < htmlRange.index
+}
+
+// parseAccept parses the media ranges of an Accept header, skipping invalid ranges
+func parseAccept(header string) []acceptRange {
+	ranges := make([]acceptRange, 0)
+
+	for i, accept := range strings.Split(header, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+
+		if value, exists := params["q"]; exists {
+			if quality, err = strconv.ParseFloat(value, 64); err != nil || quality < 0 || quality > 1 {
+				continue
+			}
+		}
+
+		ranges = append(ranges, acceptRange{mediaType: mediaType, quality: quality, index: i})
+	}
+
+	return ranges
+}
+
+// bestRange returns the most specific range matching a type: an exact match, then its subtype wildcard, then */*
+func bestRange(ranges []acceptRange, exact func(mediaType string) bool, wildcard string) *acceptRange {
+	var best *acceptRange
+	bestSpecificity := 0
+
+	for i, accept := range ranges {
+		specificity := 0
+
+		switch {
+		case exact(accept.mediaType):
+			specificity = 3
+		case accept.mediaType == wildcard:
+			specificity = 2
+		case accept.mediaType == "*/*":
+			specificity = 1
+		}
+
+		if specificity > bestSpecificity {
+			best, bestSpecificity = &ranges[i], specificity
+		}
+	}
+
+	return best
+}
+
+// stripPort removes the port from a Host header
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+
+	return host
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWantsJSON(t *testing.T) {
+	tests := map[string]bool{
+		"":                                        false,
+		"application/json":                        true,
+		"application/problem+json":                true,
+		"text/html":                               false,
+		"*/*":                                     false,
+		"text/html,application/json":              false,
+		"application/json,text/html":              true,
+		"application/json;q=0.9,text/html;q=0.8":  true,
+		"text/html;q=0.5,application/json":        true,
+		"text/html,application/json;q=0.9,*/*":    false,
+		"application/json;q=0":                    false,
+		"application/json;q=0,*/*":                false,
+		"application/*,text/html;q=0.5":           true,
+		"text/*;q=0.5,application/json;q=0.8":     true,
+		"application/json;q=0.5,*/*":              false,
+		"application/json, text/html;q=invalid":   true,
+		"text/html;q=0,application/json;q=0.1":    true,
+		"application/json;q=0.8,text/html;q=0.8 ": true,
+	}
+
+	for accept, expected := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept", accept)
+
+		if result := wantsJSON(r); result != expected {
+			t.Errorf("wantsJSON(%q) = %v, expected %v", accept, result, expected)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	gossh "golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v2"
+)
+
+// Permissions control what a key may do.
+// A nil *Permissions is unrestricted, as are empty host and protocol lists and zero limits.
+// MaxHosts limits the hosts a key owns or co-owns.
+type Permissions struct {
+	Hosts       []string `yaml:"hosts"`
+	AllowRandom *bool    `yaml:"allowRandom"`
+	MaxTunnels  int      `yaml:"maxTunnels"`
+	MaxHosts    int      `yaml:"maxHosts"`
+	Protocols   []string `yaml:"protocols"`
+}
+
+// AllowsHost checks host against the allowed host patterns (for example *.dev.example.com), see MatchesHostPattern
+func (p *Permissions) AllowsHost(host string) bool {
+	if p == nil || len(p.Hosts) == 0 {
+		return true
+	}
+
+	for _, pattern := range p.Hosts {
+		if MatchesHostPattern(pattern, host) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AllowsRandom checks if the key may forward randomly assigned hosts
+func (p *Permissions) AllowsRandom() bool {
+	return p == nil || p.AllowRandom == nil || *p.AllowRandom
+}
+
+// AllowsProtocol checks if the key may use a forwarding protocol
+func (p *Permissions) AllowsProtocol(protocol string) bool {
+	if p == nil || len(p.Protocols) == 0 {
+		return true
+	}
+
+	for _, allowed := range p.Protocols {
+		if allowed == protocol {
+			return true
+		}
+	}
+
+	return false
+}
+
+// policyRule assigns permissions to keys and groups
+type policyRule struct {
+	Permissions `yaml:",inline"`
+	Keys        []string `yaml:"keys"`
+	Groups      []string `yaml:"groups"`
+}
+
+// policyFile is the YAML representation of a Policy
+type policyFile struct {
+	Groups  map[string][]string `yaml:"groups"`
+	Rules   []policyRule        `yaml:"rules"`
+	Default *Permissions        `yaml:"default"`
+}
+
+// Policy maps public keys to their permissions.
+// Keys not matching any rule use the default permissions, or are denied if there is no default.
+type Policy struct {
+	keys map[string]*Permissions
+	def  *Permissions
+}
+
+// ParsePolicy parses a YAML policy, for example:
+//
+//	groups:
+//	  developers:
+//	    - ssh-ed25519 AAAA... alice
+//	rules:
+//	  - groups: [developers]
+//	    hosts: ["*.dev.example.com"]
+//	    allowRandom: false
+//	    maxTunnels: 5
+//	    maxHosts: 10
+//	    protocols: [http]
+//	default:
+//	  maxTunnels: 1
+//
+// When a key matches multiple rules, the first rule applies.
+func ParsePolicy(data []byte) (*Policy, error) {
+	var file policyFile
+
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+
+	p := &Policy{
+		keys: make(map[string]*Permissions),
+		def:  file.Default,
+	}
+
+	for i := range file.Rules {
+		rule := &file.Rules[i]
+
+		keys := rule.Keys
+
+		for _, group := range rule.Groups {
+			groupKeys, exists := file.Groups[group]
+
+			if !exists {
+				return nil, fmt.Errorf("rule %d: unknown group %s", i+1, group)
+			}
+
+			keys = append(keys, groupKeys...)
+		}
+
+		for _, key := range keys {
+			pubKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(key))
+
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid key %q: %w", i+1, key, err)
+			}
+
+			keyStr := marshalKey(pubKey)
+
+			if _, exists := p.keys[keyStr]; !exists {
+				p.keys[keyStr] = &rule.Permissions
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// Lookup returns the permissions of a key, and false if the key isn't allowed
+func (p *Policy) Lookup(key string) (*Permissions, bool) {
+	if perms, exists := p.keys[key]; exists {
+		return perms, true
+	}
+
+	return p.def, p.def != nil
+}
+
+// permissionsFromContext returns the permissions assigned to the connection during authentication
+func permissionsFromContext(ctx ssh.Context) *Permissions {
+	perms, _ := ctx.Value("permissions").(*Permissions)
+
+	return perms
+}
@@ -0,0 +1,37 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestPermissionsAllowsHost(t *testing.T) {
+	perms := &Permissions{Hosts: []string{"*.dev.example.com", "app.example.com", "api-*.example.com"}}
+
+	tests := map[string]bool{
+		"app.example.com":          true,
+		"test.dev.example.com":     true,
+		"*.dev.example.com":        true,
+		"api-v1.example.com":       true,
+		"a.test.dev.example.com":   false,
+		"dev.example.com":          false,
+		"other.example.com":        false,
+		"api-v1.test.example.com":  false,
+		"test.dev.example.com.net": false,
+	}
+
+	for host, expected := range tests {
+		if result := perms.AllowsHost(host); result != expected {
+			t.Errorf("AllowsHost(%q) = %v, expected %v", host, result, expected)
+		}
+	}
+
+	var unrestricted *Permissions
+
+	if !unrestricted.AllowsHost("a.test.dev.example.com") {
+		t.Error("nil permissions don't allow every host")
+	}
+
+	if !(&Permissions{Hosts: []string{"*"}}).AllowsHost("a.test.dev.example.com") {
+		t.Error("* pattern doesn't allow every host")
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"gogrok.ccatss.dev/common"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// ringReplicas is the number of points each member has on a consistent hash ring
+const ringReplicas = 64
+
+// forwardPool contains the forwards serving a host.
+// Hosts which aren't pooled have a single member and an empty strategy.
+type forwardPool struct {
+	strategy string
+	cookie   string
+	members  []*Forward
+	ring     []ringPoint
+	next     uint32
+
+	sync.RWMutex
+}
+
+// ringPoint is a member's point on a consistent hash ring
+type ringPoint struct {
+	hash   uint64
+	member *Forward
+}
+
+// ValidPoolStrategy checks if strategy is a known pool strategy
+func ValidPoolStrategy(strategy string) bool {
+	switch strategy {
+	case common.PoolRoundRobin, common.PoolLeastInFlight, common.PoolHashIP, common.PoolHashCookie:
+		return true
+	}
+
+	return false
+}
+
+// newForwardPool creates a pool using strategy, where an empty strategy holds a single forward
+func newForwardPool(strategy, cookie string) *forwardPool {
+	return &forwardPool{
+		strategy: strategy,
+		cookie:   cookie,
+	}
+}
+
+// pooled checks if the pool accepts more than one forward
+func (p *forwardPool) pooled() bool {
+	return p.strategy != ""
+}
+
+// add adds a forward to the pool
+func (p *forwardPool) add(fw *Forward) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.members = append(p.members, fw)
+	p.buildRing()
+}
+
+// remove removes a forward from the pool, returning the number of remaining members and if fw was a member
+func (p *forwardPool) remove(fw *Forward) (int, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	for i, member := range p.members {
+		if member == fw {
+			p.members = append(p.members[:i:i], p.members[i+1:]...)
+			p.buildRing()
+			return len(p.members), true
+		}
+	}
+
+	return len(p.members), false
+}
+
+// forwards returns a copy of the pool's members
+func (p *forwardPool) forwards() []*Forward {
+	p.RLock()
+	defer p.RUnlock()
+
+	members := make([]*Forward, len(p.members))
+	copy(members, p.members)
+
+	return members
+}
+
+// pick selects the forward to serve a request from clientAddr, skipping unhealthy forwards.
+// nil is returned if no forwards are healthy.
+func (p *forwardPool) pick(r *http.Request, clientAddr string) *Forward {
+	p.RLock()
+	defer p.RUnlock()
+
+	switch len(p.members) {
+	case 0:
+		return nil
+	case 1:
+		if !p.members[0].Healthy() {
+			return nil
+		}
+
+		return p.members[0]
+	}
+
+	switch p.strategy {
+	case common.PoolLeastInFlight:
+		return p.leastInFlight()
+	case common.PoolHashIP, common.PoolHashCookie:
+		key := clientAddr
+
+		if ip, _, err := net.SplitHostPort(clientAddr); err == nil {
+			key = ip
+		}
+
+		if p.strategy == common.PoolHashCookie && p.cookie != "" {
+			if cookie, err := r.Cookie(p.cookie); err == nil && cookie.Value != "" {
+				key = cookie.Value
+			}
+		}
+
+		return p.lookup(key)
+	default:
+		for range p.members {
+			if member := p.members[p.nextIndex()]; member.Healthy() {
+				return member
+			}
+		}
+
+		return nil
+	}
+}
+
+// nextIndex returns the next member index in round robin order
+func (p *forwardPool) nextIndex() int {
+	return int((atomic.AddUint32(&p.next, 1) - 1) % uint32(len(p.members)))
+}
+
+// leastInFlight returns the member with the fewest requests in flight, starting from the next round robin member to spread ties
+func (p *forwardPool) leastInFlight() *Forward {
+	start := p.nextIndex()
+
+	var best *Forward
+
+	for i := range p.members {
+		member := p.members[(start+i)%len(p.members)]
+
+		if !member.Healthy() {
+			continue
+		}
+
+		if best == nil || member.InFlight() < best.InFlight() {
+			best = member
+		}
+	}
+
+	return best
+}
+
+// lookup returns the member owning key on the hash ring.
+// Keys of unhealthy members move to the next healthy member on the ring.
+func (p *forwardPool) lookup(key string) *Forward {
+	hash := hashKey(key)
+
+	idx := sort.Search(len(p.ring), func(i int) bool {
+		return p.ring[i].hash >= hash
+	})
+
+	for i := range p.ring {
+		if member := p.ring[(idx+i)%len(p.ring)].member; member.Healthy() {
+			return member
+		}
+	}
+
+	return nil
+}
+
+// buildRing places each member on the hash ring, keeping the keys of remaining members in place when members change
+func (p *forwardPool) buildRing() {
+	if p.strategy != common.PoolHashIP && p.strategy != common.PoolHashCookie {
+		return
+	}
+
+	ring := make([]ringPoint, 0, len(p.members)*ringReplicas)
+
+	for _, member := range p.members {
+		for i := 0; i < ringReplicas; i++ {
+			ring = append(ring, ringPoint{
+				hash:   hashKey(member.id + "#" + strconv.Itoa(i)),
+				member: member,
+			})
+		}
+	}
+
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+
+	p.ring = ring
+}
+
+// hashKey hashes a ring key.
+// Ring keys only differ in their last bytes, so a hash with good avalanche is used to spread them evenly.
+func hashKey(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// forwardID identifies a forward by its ssh session
+func forwardID(sessionID []byte) string {
+	return hex.EncodeToString(sessionID)
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"gogrok.ccatss.dev/common"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+// testPool creates a pool with n healthy members named 0 to n-1
+func testPool(strategy string, n int) (*forwardPool, []*Forward) {
+	pool := newForwardPool(strategy, "session")
+	members := make([]*Forward, n)
+
+	for i := range members {
+		members[i] = &Forward{id: strconv.Itoa(i)}
+		pool.add(members[i])
+	}
+
+	return pool, members
+}
+
+func TestValidPoolStrategy(t *testing.T) {
+	tests := map[string]bool{
+		common.PoolRoundRobin:    true,
+		common.PoolLeastInFlight: true,
+		common.PoolHashIP:        true,
+		common.PoolHashCookie:    true,
+		"":                       false,
+		"random":                 false,
+	}
+
+	for strategy, valid := range tests {
+		if ValidPoolStrategy(strategy) != valid {
+			t.Errorf("ValidPoolStrategy(%q) = %v, expected %v", strategy, !valid, valid)
+		}
+	}
+}
+
+// visitorRequest creates a request from visitor i, identified by a cookie for hash-cookie pools and its address otherwise
+func visitorRequest(strategy string, i int) (*http.Request, string) {
+	r, _ := http.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+
+	if strategy == common.PoolHashCookie {
+		r.AddCookie(&http.Cookie{Name: "session", Value: "visitor-" + strconv.Itoa(i)})
+
+		// The cookie takes precedence over the address
+		return r, "192.0.2.1:1234"
+	}
+
+	return r, "192.0.2." + strconv.Itoa(i) + ":1234"
+}
+
+func TestPoolPick(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy string
+		members  int
+		setup    func(members []*Forward)
+		expected []string
+	}{
+		{
+			name:     "single member",
+			strategy: "",
+			members:  1,
+			expected: []string{"0", "0"},
+		},
+		{
+			name:     "single unhealthy member",
+			strategy: "",
+			members:  1,
+			setup: func(members []*Forward) {
+				members[0].unhealthy = 1
+			},
+			expected: []string{""},
+		},
+		{
+			name:     "round robin",
+			strategy: common.PoolRoundRobin,
+			members:  3,
+			expected: []string{"0", "1", "2", "0"},
+		},
+		{
+			name:     "round robin skips unhealthy",
+			strategy: common.PoolRoundRobin,
+			members:  3,
+			setup: func(members []*Forward) {
+				members[1].unhealthy = 1
+			},
+			expected: []string{"0", "2", "0", "2"},
+		},
+		{
+			name:     "round robin all unhealthy",
+			strategy: common.PoolRoundRobin,
+			members:  2,
+			setup: func(members []*Forward) {
+				members[0].unhealthy = 1
+				members[1].unhealthy = 1
+			},
+			expected: []string{""},
+		},
+		{
+			name:     "least in flight",
+			strategy: common.PoolLeastInFlight,
+			members:  3,
+			setup: func(members []*Forward) {
+				members[0].inFlight = 4
+				members[1].inFlight = 1
+				members[2].inFlight = 2
+			},
+			expected: []string{"1", "1", "1"},
+		},
+		{
+			name:     "least in flight skips unhealthy",
+			strategy: common.PoolLeastInFlight,
+			members:  3,
+			setup: func(members []*Forward) {
+				members[0].inFlight = 4
+				members[1].unhealthy = 1
+				members[2].inFlight = 2
+			},
+			expected: []string{"2", "2"},
+		},
+	}
+
+	for _, test := range tests {
+		pool, members := testPool(test.strategy, test.members)
+
+		if test.setup != nil {
+			test.setup(members)
+		}
+
+		for i, expected := range test.expected {
+			picked := ""
+
+			if fw := pool.pick(visitorRequest(test.strategy, 1)); fw != nil {
+				picked = fw.id
+			}
+
+			if picked != expected {
+				t.Errorf("%s: pick %d returned %q, expected %q", test.name, i, picked, expected)
+			}
+		}
+	}
+}
+
+func TestPoolHashSticky(t *testing.T) {
+	for _, strategy := range []string{common.PoolHashIP, common.PoolHashCookie} {
+		pool, members := testPool(strategy, 4)
+
+		picks := make(map[int]string)
+		used := make(map[string]bool)
+
+		for i := 0; i < 64; i++ {
+			r, addr := visitorRequest(strategy, i)
+
+			first := pool.pick(r, addr)
+
+			for j := 0; j < 3; j++ {
+				if fw := pool.pick(r, addr); fw != first {
+					t.Fatalf("%s: visitor %d moved between picks", strategy, i)
+				}
+			}
+
+			picks[i] = first.id
+			used[first.id] = true
+		}
+
+		if len(used) < 2 {
+			t.Errorf("%s: visitors weren't spread between members: %v", strategy, used)
+		}
+
+		// Only the visitors of a removed member move
+		removed := members[0]
+		pool.remove(removed)
+
+		for i := 0; i < 64; i++ {
+			fw := pool.pick(visitorRequest(strategy, i))
+
+			if fw == removed {
+				t.Fatalf("%s: removed member was picked", strategy)
+			}
+
+			if before := picks[i]; before != removed.id && fw.id != before {
+				t.Errorf("%s: visitor %d moved from %s to %s", strategy, i, before, fw.id)
+			}
+		}
+	}
+}
+
+func TestPoolHashSkipsUnhealthy(t *testing.T) {
+	pool, members := testPool(common.PoolHashIP, 3)
+
+	r, addr := visitorRequest(common.PoolHashIP, 1)
+
+	first := pool.pick(r, addr)
+	first.unhealthy = 1
+
+	fw := pool.pick(r, addr)
+
+	if fw == nil || fw == first {
+		t.Fatalf("expected a healthy member, got %v", fw)
+	}
+
+	for _, member := range members {
+		member.unhealthy = 1
+	}
+
+	if fw := pool.pick(r, addr); fw != nil {
+		t.Errorf("expected no member when all are unhealthy, got %s", fw.id)
+	}
+}
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"gogrok.ccatss.dev/server/store"
+	"io"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode"
+)
+
+const (
+	// DefaultHostTemplate is the template used for random hosts when none is set
+	DefaultHostTemplate = "{{animal}}"
+
+	// maxHostAttempts is the number of hosts tried before giving up on finding an unused random host
+	maxHostAttempts = 16
+
+	// maxTemplateLength is the largest number of characters generated by hex and digits
+	maxTemplateLength = 32
+)
+
+var (
+	//go:embed adjectives.txt
+	adjectiveBytes []byte
+	adjectives     []string
+
+	wordListName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	ErrHostsExhausted = errors.New("no random hosts available")
+)
+
+func init() {
+	adjectives = parseWordList(adjectiveBytes)
+}
+
+// WordLists maps template function names to the words they choose from, for example "animal" used as {{animal}}
+type WordLists map[string][]string
+
+// DefaultWordLists returns the built in word lists, animal and adjective
+func DefaultWordLists() WordLists {
+	return WordLists{
+		"animal":    animals,
+		"adjective": adjectives,
+	}
+}
+
+// LoadWordList reads a word list with one word per line, ignoring empty lines and comments starting with #.
+// Words must be valid host labels.
+func LoadWordList(r io.Reader) ([]string, error) {
+	words := make([]string, 0)
+
+	s := bufio.NewScanner(r)
+
+	for line := 1; s.Scan(); line++ {
+		word := strings.ToLower(strings.TrimSpace(s.Text()))
+
+		if word == "" || word[0] == '#' {
+			continue
+		}
+
+		if !IsDomainName(word + ".example") {
+			return nil, fmt.Errorf("invalid word %q on line %d", word, line)
+		}
+
+		words = append(words, word)
+	}
+
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(words) == 0 {
+		return nil, errors.New("word list is empty")
+	}
+
+	return words, nil
+}
+
+// parseWordList parses an embedded word list
+func parseWordList(b []byte) []string {
+	words, err := LoadWordList(bytes.NewReader(b))
+
+	if err != nil {
+		panic(err)
+	}
+
+	return words
+}
+
+// keyedProvider adapts a HostProvider to a KeyedHostProvider, ignoring the client's key
+func keyedProvider(provider HostProvider) KeyedHostProvider {
+	return func(key string, attempt int) string {
+		return provider()
+	}
+}
+
+// HostTemplate generates random hosts from a template such as {{adjective}}-{{animal}}-{{hex 4}}.
+// Each word list is available as a function, along with {{hex n}} and {{digits n}}.
+// Generated hosts are suffixed with a random domain.
+type HostTemplate struct {
+	tmpl    *template.Template
+	words   WordLists
+	domains []string
+
+	// pattern matches every host the template can generate
+	pattern *regexp.Regexp
+
+	// random is shared by hosts from Random, and isn't safe for concurrent use
+	random   *rand.Rand
+	randomMu sync.Mutex
+}
+
+// NewHostTemplate parses text and checks it generates valid hosts on domains
+func NewHostTemplate(text string, words WordLists, domains []string) (*HostTemplate, error) {
+	if len(domains) == 0 {
+		return nil, errors.New("host templates require at least one domain")
+	}
+
+	for name, list := range words {
+		if !wordListName.MatchString(name) || name == "hex" || name == "digits" {
+			return nil, fmt.Errorf("invalid word list name %q", name)
+		}
+
+		if len(list) == 0 {
+			return nil, fmt.Errorf("word list %s is empty", name)
+		}
+	}
+
+	tmpl, err := template.New("host").Funcs(templateFuncs(words, rand.New(rand.NewSource(0)))).Parse(text)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid host template")
+	}
+
+	pattern, err := templatePattern(tmpl, words, domains)
+
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid host template")
+	}
+
+	t := &HostTemplate{
+		tmpl:    tmpl,
+		words:   words,
+		domains: domains,
+		pattern: pattern,
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	host, err := t.execute(rand.New(rand.NewSource(0)))
+
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid host template")
+	}
+
+	if !IsDomainName(host) {
+		return nil, fmt.Errorf("host template generates invalid host %q", host)
+	}
+
+	return t, nil
+}
+
+// Random returns a HostProvider generating random hosts
+func (t *HostTemplate) Random() HostProvider {
+	return func() string {
+		t.randomMu.Lock()
+		defer t.randomMu.Unlock()
+
+		return t.generate(t.random)
+	}
+}
+
+// Keyed returns a KeyedHostProvider where the host is derived from the client's public key.
+// Each key is given the same host on every connection, unless the host is taken and another attempt is made.
+func (t *HostTemplate) Keyed() KeyedHostProvider {
+	return func(key string, attempt int) string {
+		sum := sha256.Sum256([]byte(key + "\x00" + strconv.Itoa(attempt)))
+
+		return t.generate(rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(sum[:8])))))
+	}
+}
+
+// Validator returns a HostValidator denying every host the template can generate, reserving them for random use
+func (t *HostTemplate) Validator() HostValidator {
+	return func(host string) bool {
+		return !t.pattern.MatchString(host)
+	}
+}
+
+// generate executes the template, returning an empty string when the generated host is invalid (for example, too long)
+func (t *HostTemplate) generate(r *rand.Rand) string {
+	host, err := t.execute(r)
+
+	if err != nil || !IsDomainName(host) {
+		return ""
+	}
+
+	return host
+}
+
+// execute executes the template using r as the source of randomness, then adds a domain
+func (t *HostTemplate) execute(r *rand.Rand) (string, error) {
+	tmpl, err := t.tmpl.Clone()
+
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+
+	if err := tmpl.Funcs(templateFuncs(t.words, r)).Execute(&buf, nil); err != nil {
+		return "", err
+	}
+
+	domain := t.domains[r.Intn(len(t.domains))]
+
+	return strings.ToLower(strings.TrimSpace(buf.String())) + "." + domain, nil
+}
+
+// templatePattern builds a regular expression matching every host tmpl can generate on domains.
+// Only text and calls of the template functions are supported, so the pattern is exact.
+func templatePattern(tmpl *template.Template, words WordLists, domains []string) (*regexp.Regexp, error) {
+	var pattern strings.Builder
+
+	nodes := tmpl.Tree.Root.Nodes
+
+	for i, node := range nodes {
+		switch n := node.(type) {
+		case *parse.TextNode:
+			text := strings.ToLower(string(n.Text))
+
+			// Generated hosts are trimmed
+			if i == 0 {
+				text = strings.TrimLeftFunc(text, unicode.IsSpace)
+			}
+
+			if i == len(nodes)-1 {
+				text = strings.TrimRightFunc(text, unicode.IsSpace)
+			}
+
+			pattern.WriteString(regexp.QuoteMeta(text))
+		case *parse.ActionNode:
+			expr, err := actionPattern(n, words)
+
+			if err != nil {
+				return nil, err
+			}
+
+			pattern.WriteString(expr)
+		default:
+			return nil, fmt.Errorf("unsupported template action %s", node)
+		}
+	}
+
+	quoted := make([]string, len(domains))
+
+	for i, domain := range domains {
+		quoted[i] = regexp.QuoteMeta(domain)
+	}
+
+	return regexp.Compile("^(?:" + pattern.String() + `)\.(?:` + strings.Join(quoted, "|") + ")$")
+}
+
+// actionPattern returns the regular expression matching the output of a template function call
+func actionPattern(action *parse.ActionNode, words WordLists) (string, error) {
+	if len(action.Pipe.Decl) > 0 || len(action.Pipe.Cmds) != 1 {
+		return "", fmt.Errorf("unsupported template action %s", action)
+	}
+
+	args := action.Pipe.Cmds[0].Args
+
+	ident, ok := args[0].(*parse.IdentifierNode)
+
+	if !ok {
+		return "", fmt.Errorf("unsupported template action %s", action)
+	}
+
+	switch ident.Ident {
+	case "hex", "digits":
+		if len(args) != 2 {
+			return "", fmt.Errorf("%s requires a length", ident.Ident)
+		}
+
+		length, ok := args[1].(*parse.NumberNode)
+
+		if !ok || !length.IsInt || length.Int64 < 1 || length.Int64 > maxTemplateLength {
+			return "", fmt.Errorf("%s length must be between 1 and %d", ident.Ident, maxTemplateLength)
+		}
+
+		chars := "[0-9a-f]"
+
+		if ident.Ident == "digits" {
+			chars = "[0-9]"
+		}
+
+		return chars + "{" + strconv.FormatInt(length.Int64, 10) + "}", nil
+	}
+
+	list, exists := words[ident.Ident]
+
+	if !exists || len(args) != 1 {
+		return "", fmt.Errorf("unsupported template action %s", action)
+	}
+
+	quoted := make([]string, len(list))
+
+	for i, word := range list {
+		quoted[i] = regexp.QuoteMeta(word)
+	}
+
+	return "(?:" + strings.Join(quoted, "|") + ")", nil
+}
+
+// templateFuncs returns the template functions, choosing words and characters using r
+func templateFuncs(words WordLists, r *rand.Rand) template.FuncMap {
+	funcs := template.FuncMap{
+		"hex": func(n int) (string, error) {
+			return randomChars(r, "0123456789abcdef", n)
+		},
+		"digits": func(n int) (string, error) {
+			return randomChars(r, "0123456789", n)
+		},
+	}
+
+	for name, list := range words {
+		list := list
+
+		funcs[name] = func() string {
+			return list[r.Intn(len(list))]
+		}
+	}
+
+	return funcs
+}
+
+// randomChars returns n characters chosen from chars
+func randomChars(r *rand.Rand, chars string, n int) (string, error) {
+	if n < 1 || n > maxTemplateLength {
+		return "", fmt.Errorf("length must be between 1 and %d", maxTemplateLength)
+	}
+
+	b := make([]byte, n)
+
+	for i := range b {
+		b[i] = chars[r.Intn(len(chars))]
+	}
+
+	return string(b), nil
+}
+
+// randomHost asks the provider for hosts until one is unused, giving up after maxHostAttempts
+func (h *ForwardedHTTPHandler) randomHost(key string) (string, error) {
+	h.RLock()
+	provider := h.provider
+	h.RUnlock()
+
+	for attempt := 0; attempt < maxHostAttempts; attempt++ {
+		host := provider(key, attempt)
+
+		if host != "" && h.hostAvailable(host) {
+			return host, nil
+		}
+	}
+
+	return "", ErrHostsExhausted
+}
+
+// hostAvailable checks a random host isn't forwarded on this or another node, or registered
+func (h *ForwardedHTTPHandler) hostAvailable(host string) bool {
+	h.RLock()
+	_, exists := h.forwards[host]
+	h.RUnlock()
+
+	if exists {
+		return false
+	}
+
+	if h.cluster != nil {
+		if _, remote := h.cluster.Lookup(host); remote {
+			return false
+		}
+	}
+
+	if h.store != nil {
+		if _, err := store.Lookup(h.store, host); err == nil {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+var testWords = WordLists{
+	"animal":    {"cat", "dog"},
+	"adjective": {"red", "blue"},
+}
+
+func TestNewHostTemplate(t *testing.T) {
+	tests := []struct {
+		text    string
+		words   WordLists
+		domains []string
+		wantErr bool
+	}{
+		{text: DefaultHostTemplate, words: testWords, domains: []string{"example.com"}},
+		{text: "{{adjective}}-{{animal}}-{{hex 4}}", words: testWords, domains: []string{"example.com"}},
+		{text: "app{{digits 6}}", words: testWords, domains: []string{"example.com"}},
+		{text: DefaultHostTemplate, words: testWords, wantErr: true},
+		{text: "{{animal", words: testWords, domains: []string{"example.com"}, wantErr: true},
+		{text: "{{plant}}", words: testWords, domains: []string{"example.com"}, wantErr: true},
+		{text: "{{hex 0}}", words: testWords, domains: []string{"example.com"}, wantErr: true},
+		{text: "{{hex 33}}", words: testWords, domains: []string{"example.com"}, wantErr: true},
+		{text: "{{if true}}{{animal}}{{end}}", words: testWords, domains: []string{"example.com"}, wantErr: true},
+		{text: "{{animal}}_{{animal}}", words: testWords, domains: []string{"example.com"}, wantErr: true},
+		{text: DefaultHostTemplate, words: WordLists{"hex": {"a"}}, domains: []string{"example.com"}, wantErr: true},
+		{text: DefaultHostTemplate, words: WordLists{"animal": {}}, domains: []string{"example.com"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		_, err := NewHostTemplate(test.text, test.words, test.domains)
+
+		if test.wantErr && err == nil {
+			t.Errorf("NewHostTemplate(%q) expected an error", test.text)
+		} else if !test.wantErr && err != nil {
+			t.Errorf("NewHostTemplate(%q) returned error: %v", test.text, err)
+		}
+	}
+}
+
+func TestHostTemplateRandom(t *testing.T) {
+	tmpl, err := NewHostTemplate("{{adjective}}-{{animal}}-{{hex 4}}", testWords, []string{"a.example.com", "b.example.com"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := tmpl.Random()
+	validator := tmpl.Validator()
+
+	for i := 0; i < 100; i++ {
+		host := provider()
+
+		if !IsDomainName(host) {
+			t.Fatalf("generated invalid host %q", host)
+		}
+
+		if !strings.HasSuffix(host, ".a.example.com") && !strings.HasSuffix(host, ".b.example.com") {
+			t.Fatalf("generated host %q outside of the domains", host)
+		}
+
+		// Every generated host is reserved for random use
+		if validator(host) {
+			t.Fatalf("validator allows generated host %q", host)
+		}
+	}
+}
+
+func TestHostTemplateRandomConcurrent(t *testing.T) {
+	tmpl, err := NewHostTemplate("{{animal}}-{{hex 8}}", testWords, []string{"example.com"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := tmpl.Random()
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				if host := provider(); !IsDomainName(host) {
+					t.Errorf("generated invalid host %q", host)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+func TestHostTemplateKeyed(t *testing.T) {
+	tmpl, err := NewHostTemplate("{{animal}}-{{hex 8}}", testWords, []string{"example.com"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := tmpl.Keyed()
+
+	if provider("key-a", 0) != provider("key-a", 0) {
+		t.Error("keyed provider returned different hosts for the same key and attempt")
+	}
+
+	if provider("key-a", 0) == provider("key-b", 0) {
+		t.Error("keyed provider returned the same host for different keys")
+	}
+
+	if provider("key-a", 0) == provider("key-a", 1) {
+		t.Error("keyed provider returned the same host for another attempt")
+	}
+}
+
+func TestHostTemplateValidator(t *testing.T) {
+	tmpl, err := NewHostTemplate("{{adjective}}-{{animal}}-{{digits 2}}", testWords, []string{"example.com"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validator := tmpl.Validator()
+
+	tests := map[string]bool{
+		"red-cat-42.example.com":    false,
+		"blue-dog-00.example.com":   false,
+		"red-cat-4.example.com":     true,
+		"red-cat-42a.example.com":   true,
+		"green-cat-42.example.com":  true,
+		"red-cat-42.example.org":    true,
+		"x.red-cat-42.example.com":  true,
+		"red-cat-42.x.example.com":  true,
+		"cat.example.com":           true,
+		"red-cat-4x2.example.com":   true,
+		"blue-dog-99.example.com":   false,
+		"blue-dog-99.example.com.x": true,
+	}
+
+	for host, allowed := range tests {
+		if validator(host) != allowed {
+			t.Errorf("validator(%q) = %v, expected %v", host, !allowed, allowed)
+		}
+	}
+}
+
+func TestLoadWordList(t *testing.T) {
+	tests := []struct {
+		data    string
+		words   []string
+		wantErr bool
+	}{
+		{data: "cat\nDog\n\n# comment\n  fox  \n", words: []string{"cat", "dog", "fox"}},
+		{data: "# only comments\n\n", wantErr: true},
+		{data: "cat\nnot a label\n", wantErr: true},
+		{data: "cat\n-dog\n", wantErr: true},
+	}
+
+	for _, test := range tests {
+		words, err := LoadWordList(strings.NewReader(test.data))
+
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("LoadWordList(%q) expected an error", test.data)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("LoadWordList(%q) returned error: %v", test.data, err)
+			continue
+		}
+
+		if strings.Join(words, ",") != strings.Join(test.words, ",") {
+			t.Errorf("LoadWordList(%q) = %v, expected %v", test.data, words, test.words)
+		}
+	}
+}
@@ -6,10 +6,13 @@ import (
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"gogrok.ccatss.dev/common"
+	"gogrok.ccatss.dev/proxyproto"
 	gossh "golang.org/x/crypto/ssh"
-	"io"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
+	"time"
 )
 
 // ForwardHandler is an interface defining the handler type for forwarding
@@ -26,7 +29,14 @@ type Server struct {
 	sshBindAddress string
 	hostSigners    []ssh.Signer
 
-	authorizedKeys []string
+	sshProxyProtocol  bool
+	httpProxyProtocol bool
+
+	authorizedKeys map[string]*AuthorizedKey
+	policy         *Policy
+	adminKeys      map[string]bool
+	started        time.Time
+	sync.RWMutex
 }
 
 // Option defines types for server options
@@ -47,6 +57,20 @@ func WithSSHAddress(address string) Option {
 	}
 }
 
+// WithSSHProxyProtocol requires a PROXY protocol header on SSH connections, for servers behind an L4 load balancer
+func WithSSHProxyProtocol() Option {
+	return func(s *Server) {
+		s.sshProxyProtocol = true
+	}
+}
+
+// WithHTTPProxyProtocol requires a PROXY protocol header on connections to the server started by StartHTTP
+func WithHTTPProxyProtocol() Option {
+	return func(s *Server) {
+		s.httpProxyProtocol = true
+	}
+}
+
 // WithSigner sets the host signer for the server
 func WithSigner(signer gossh.Signer) Option {
 	return func(s *Server) {
@@ -71,7 +95,43 @@ func WithDSAKey(key *dsa.PrivateKey) Option {
 // WithAuthorizedKeys sets the authorized keys to connect to this server
 func WithAuthorizedKeys(authorizedKeys []string) Option {
 	return func(s *Server) {
-		s.authorizedKeys = authorizedKeys
+		s.authorizedKeys = authorizedKeyMap(keysWithoutOptions(authorizedKeys))
+	}
+}
+
+// WithAuthorizedKeyEntries sets the authorized keys to connect to this server, including their restrictions
+func WithAuthorizedKeyEntries(authorizedKeys []*AuthorizedKey) Option {
+	return func(s *Server) {
+		s.authorizedKeys = authorizedKeyMap(authorizedKeys)
+	}
+}
+
+// keysWithoutOptions converts marshalled keys into unrestricted AuthorizedKey entries
+func keysWithoutOptions(keys []string) []*AuthorizedKey {
+	authorizedKeys := make([]*AuthorizedKey, len(keys))
+
+	for i, key := range keys {
+		authorizedKeys[i] = &AuthorizedKey{Key: key}
+	}
+
+	return authorizedKeys
+}
+
+// authorizedKeyMap indexes authorized keys by their marshalled key
+func authorizedKeyMap(authorizedKeys []*AuthorizedKey) map[string]*AuthorizedKey {
+	keys := make(map[string]*AuthorizedKey)
+
+	for _, key := range authorizedKeys {
+		keys[key.Key] = key
+	}
+
+	return keys
+}
+
+// WithPolicy sets the policy controlling what each key may do
+func WithPolicy(policy *Policy) Option {
+	return func(s *Server) {
+		s.policy = policy
 	}
 }
 
@@ -79,6 +139,7 @@ func WithAuthorizedKeys(authorizedKeys []string) Option {
 func New(options ...Option) (*Server, error) {
 	s := &Server{
 		forwardHandlers: make(map[string]ForwardHandler),
+		started:         time.Now(),
 	}
 
 	for _, opt := range options {
@@ -111,12 +172,14 @@ func New(options ...Option) (*Server, error) {
 
 	// TODO: Add TCP handler using the same idea, potentially support multiple forwardHandlers
 
-	for _, handler := range s.forwardHandlers {
+	for protocol, handler := range s.forwardHandlers {
 		for _, requestType := range handler.RequestTypes() {
-			requestHandlers[requestType] = handler.HandleSSHRequest
+			requestHandlers[requestType] = protocolHandler(protocol, handler)
 		}
 	}
 
+	requestHandlers[common.ProtocolExtensions] = extensionsHandler
+
 	s.sshServer = &ssh.Server{
 		HostSigners:      s.hostSigners,
 		Addr:             s.sshBindAddress,
@@ -129,17 +192,51 @@ func New(options ...Option) (*Server, error) {
 }
 
 // SetAuthorizedKeys is exposed as a way to set/update authorized keys during runtime
+// Existing connections are not affected.
 func (s *Server) SetAuthorizedKeys(authorizedKeys []string) {
-	s.authorizedKeys = authorizedKeys
+	s.SetAuthorizedKeyEntries(keysWithoutOptions(authorizedKeys))
+}
+
+// SetAuthorizedKeyEntries sets/updates authorized keys and their restrictions during runtime
+func (s *Server) SetAuthorizedKeyEntries(authorizedKeys []*AuthorizedKey) {
+	keys := authorizedKeyMap(authorizedKeys)
+
+	s.Lock()
+	s.authorizedKeys = keys
+	s.Unlock()
+}
+
+// SetPolicy is exposed as a way to set/update the policy during runtime
+// Existing connections keep the permissions they were authenticated with.
+func (s *Server) SetPolicy(policy *Policy) {
+	s.Lock()
+	s.policy = policy
+	s.Unlock()
 }
 
-// sshHandler is our basic ssh handler to deny regular ssh sessions.
-func (s *Server) sshHandler(session ssh.Session) {
-	supportedTypes := []string{"http", "https", "ws", "wss"}
+// extensionsHandler enables protocol extensions for the connection
+func extensionsHandler(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	ctx.SetValue("extensions", true)
 
-	io.WriteString(session, "This server supports only remote forwarding of request types: "+strings.Join(supportedTypes, ", ")+"\n")
-	io.WriteString(session, "For more information, visit https://gogrok.ccatss.dev\n")
-	session.Close()
+	return true, nil
+}
+
+// extensionsEnabled checks if the client enabled protocol extensions, so optional fields may be sent
+func extensionsEnabled(ctx ssh.Context) bool {
+	enabled, _ := ctx.Value("extensions").(bool)
+
+	return enabled
+}
+
+// protocolHandler wraps a handler's requests, denying keys without permission to use protocol
+func protocolHandler(protocol string, handler ForwardHandler) ssh.RequestHandler {
+	return func(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+		if !permissionsFromContext(ctx).AllowsProtocol(protocol) {
+			return false, []byte("protocol " + protocol + " is not allowed for this key")
+		}
+
+		return handler.HandleSSHRequest(ctx, srv, req)
+	}
 }
 
 // publicKeyHandler handles public keys when authenticating.
@@ -155,14 +252,39 @@ func (s *Server) publicKeyHandler(ctx ssh.Context, pubkey ssh.PublicKey) bool {
 
 	ctx.SetValue("publicKey", pubkey)
 
-	if s.authorizedKeys != nil {
-		for _, key := range s.authorizedKeys {
-			if key == keyMarshalled {
-				return true
-			}
+	s.RLock()
+	authorizedKeys := s.authorizedKeys
+	policy := s.policy
+	s.RUnlock()
+
+	if policy != nil {
+		perms, allowed := policy.Lookup(keyMarshalled)
+
+		if !allowed {
+			return false
 		}
 
-		return false
+		ctx.SetValue("permissions", perms)
+	}
+
+	if authorizedKeys != nil {
+		authorizedKey, exists := authorizedKeys[keyMarshalled]
+
+		if !exists {
+			return false
+		}
+
+		if authorizedKey.Expired() {
+			log.WithField("remoteAddr", ctx.RemoteAddr()).Info("Denied expired key")
+			return false
+		}
+
+		if !authorizedKey.AllowsAddress(ctx.RemoteAddr()) {
+			log.WithField("remoteAddr", ctx.RemoteAddr()).Info("Denied key from unauthorized address")
+			return false
+		}
+
+		ctx.SetValue("authorizedKey", authorizedKey)
 	}
 
 	return true
@@ -170,7 +292,23 @@ func (s *Server) publicKeyHandler(ctx ssh.Context, pubkey ssh.PublicKey) bool {
 
 // Start will start the SSH server.
 func (s *Server) Start() error {
-	return s.sshServer.ListenAndServe()
+	if !s.sshProxyProtocol {
+		return s.sshServer.ListenAndServe()
+	}
+
+	addr := s.sshServer.Addr
+
+	if addr == "" {
+		addr = ":22"
+	}
+
+	l, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	return s.sshServer.Serve(proxyproto.NewListener(l))
 }
 
 // StartHTTP is a convenience method to start a basic http server.
@@ -193,7 +331,17 @@ func (s *Server) StartHTTP(bind string) error {
 		Handler: httpHandler,
 	}
 
-	return httpServer.ListenAndServe()
+	if !s.httpProxyProtocol {
+		return httpServer.ListenAndServe()
+	}
+
+	l, err := net.Listen("tcp", bind)
+
+	if err != nil {
+		return err
+	}
+
+	return httpServer.Serve(proxyproto.NewListener(l))
 }
 
 // ServeHTTP is a passthrough to forwardHandler's ServeHTTP
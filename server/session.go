@@ -0,0 +1,535 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gliderlabs/ssh"
+	log "github.com/sirupsen/logrus"
+	"gogrok.ccatss.dev/common"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var (
+	ErrUnknownCommand  = errors.New("unknown command, run help for a list of commands")
+	ErrAdminOnly       = errors.New("this command is only available to admins")
+	ErrMissingArgument = errors.New("missing argument")
+	ErrNoTunnels       = errors.New("no tunnels found for host")
+)
+
+// sessionCommand is a command run in an ssh session, for example `ssh gogrok.example.com hosts`
+type sessionCommand struct {
+	name        string
+	args        string
+	description string
+	admin       bool
+	run         func(c *commandContext, args []string) error
+}
+
+// commandContext is passed to session commands
+type commandContext struct {
+	session ssh.Session
+	out     io.Writer
+	key     string
+	admin   bool
+}
+
+// WithAdminKeys sets the keys (in authorized keys format) which may use admin commands in ssh sessions
+func WithAdminKeys(keys []string) Option {
+	return func(s *Server) {
+		s.adminKeys = adminKeyMap(keys)
+	}
+}
+
+// SetAdminKeys is exposed as a way to set/update admin keys during runtime
+func (s *Server) SetAdminKeys(keys []string) {
+	adminKeys := adminKeyMap(keys)
+
+	s.Lock()
+	s.adminKeys = adminKeys
+	s.Unlock()
+}
+
+// adminKeyMap indexes admin keys
+func adminKeyMap(keys []string) map[string]bool {
+	adminKeys := make(map[string]bool)
+
+	for _, key := range keys {
+		adminKeys[key] = true
+	}
+
+	return adminKeys
+}
+
+// isAdmin checks if key is an admin key
+func (s *Server) isAdmin(key string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.adminKeys[key]
+}
+
+// commands returns the commands available in ssh sessions
+func (s *Server) commands() []sessionCommand {
+	return []sessionCommand{
+		{name: "help", description: "Show the available commands", run: s.helpCommand},
+		{name: "whoami", description: "Show the key you're connected with", run: s.whoamiCommand},
+		{name: "status", description: "Show your tunnels and bandwidth usage", run: s.statusCommand},
+		{name: "hosts", description: "List your registered hosts", run: s.hostsCommand},
+		{name: "register", args: "<host>", description: "Register a host to your key", run: s.registerCommand},
+		{name: "unregister", args: "<host>", description: "Unregister a host owned by your key", run: s.unregisterCommand},
+		{name: "tunnels", description: "List your connected tunnels (every tunnel for admins)", run: s.tunnelsCommand},
+		{name: "kill", args: "<host>", description: "Disconnect your clients forwarding a host (any client for admins)", run: s.killCommand},
+		{name: "stats", description: "Show server statistics", admin: true, run: s.statsCommand},
+	}
+}
+
+// sshHandler runs commands in ssh sessions, or an interactive shell when a terminal is requested without a command
+func (s *Server) sshHandler(session ssh.Session) {
+	c := &commandContext{
+		session: session,
+		out:     session,
+		key:     marshalKey(session.PublicKey()),
+	}
+
+	c.admin = s.isAdmin(c.key)
+
+	args := session.Command()
+
+	if len(args) > 0 {
+		if err := s.runCommand(c, args); err != nil {
+			fmt.Fprintln(session.Stderr(), "Error: "+err.Error())
+			session.Exit(1)
+			return
+		}
+
+		session.Exit(0)
+		return
+	}
+
+	if _, _, isPty := session.Pty(); !isPty {
+		io.WriteString(session, "This server forwards hosts to gogrok clients, and runs commands such as `ssh <server> hosts`.\n")
+		io.WriteString(session, "For more information, visit https://gogrok.ccatss.dev\n\n")
+		s.helpCommand(c, nil)
+		session.Exit(0)
+		return
+	}
+
+	s.runShell(c)
+}
+
+// runShell reads and runs commands until the session ends or the user exits
+func (s *Server) runShell(c *commandContext) {
+	t := term.NewTerminal(c.session, "gogrok> ")
+
+	c.out = t
+
+	io.WriteString(t, "Welcome to gogrok. Run help for a list of commands, or exit to disconnect.\n")
+
+	for {
+		line, err := t.ReadLine()
+
+		if err != nil {
+			break
+		}
+
+		args := strings.Fields(line)
+
+		if len(args) == 0 {
+			continue
+		}
+
+		if args[0] == "exit" || args[0] == "quit" {
+			break
+		}
+
+		if err := s.runCommand(c, args); err != nil {
+			io.WriteString(t, "Error: "+err.Error()+"\n")
+		}
+	}
+
+	c.session.Exit(0)
+}
+
+// runCommand runs a session command
+func (s *Server) runCommand(c *commandContext, args []string) error {
+	for _, cmd := range s.commands() {
+		if cmd.name != args[0] {
+			continue
+		}
+
+		if cmd.admin && !c.admin {
+			return ErrAdminOnly
+		}
+
+		log.WithFields(log.Fields{
+			"command":    args[0],
+			"remoteAddr": c.session.RemoteAddr(),
+		}).Info("Running session command")
+
+		return cmd.run(c, args[1:])
+	}
+
+	return ErrUnknownCommand
+}
+
+// request runs a global request handler for the session's connection, as if the client had sent it
+func (s *Server) request(c *commandContext, requestType string, payload interface{}) ([]byte, error) {
+	handler, exists := s.sshServer.RequestHandlers[requestType]
+
+	if !exists {
+		return nil, ErrUnknownCommand
+	}
+
+	var data []byte
+
+	if payload != nil {
+		data = gossh.Marshal(payload)
+	}
+
+	// Session commands decode the same responses as clients, without enabling extensions for the connection itself
+	ctx := extensionsContext{c.session.Context().(ssh.Context)}
+
+	ok, reply := handler(ctx, s.sshServer, &gossh.Request{
+		Type:      requestType,
+		WantReply: true,
+		Payload:   data,
+	})
+
+	if !ok {
+		return nil, errors.New(string(reply))
+	}
+
+	return reply, nil
+}
+
+// extensionsContext enables protocol extensions for a single request, leaving the connection's context unchanged
+type extensionsContext struct {
+	ssh.Context
+}
+
+func (c extensionsContext) Value(key interface{}) interface{} {
+	if key == "extensions" {
+		return true
+	}
+
+	return c.Context.Value(key)
+}
+
+// tunnels returns the forward handler's tunnel management, if supported
+func (s *Server) tunnels() (tunnelManager, error) {
+	manager, ok := s.forwardHandlers["http"].(tunnelManager)
+
+	if !ok {
+		return nil, errors.New("tunnels are not supported by this server")
+	}
+
+	return manager, nil
+}
+
+// tunnelManager is implemented by forward handlers which can list and close tunnels
+type tunnelManager interface {
+	Tunnels(key string) []Tunnel
+	CloseTunnels(host, key string) int
+}
+
+func (s *Server) helpCommand(c *commandContext, args []string) error {
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "Commands:")
+
+	for _, cmd := range s.commands() {
+		if cmd.admin && !c.admin {
+			continue
+		}
+
+		fmt.Fprintf(w, "  %s %s\t%s\n", cmd.name, cmd.args, cmd.description)
+	}
+
+	return w.Flush()
+}
+
+func (s *Server) whoamiCommand(c *commandContext, args []string) error {
+	pubKey := c.session.PublicKey()
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Key\t%s %s\n", pubKey.Type(), gossh.FingerprintSHA256(pubKey))
+	fmt.Fprintf(w, "Address\t%s\n", c.session.RemoteAddr())
+	fmt.Fprintf(w, "Admin\t%t\n", c.admin)
+
+	return w.Flush()
+}
+
+func (s *Server) statusCommand(c *commandContext, args []string) error {
+	manager, err := s.tunnels()
+
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Tunnels\t%d\n", len(manager.Tunnels(c.key)))
+
+	reply, err := s.request(c, common.HttpUsage, nil)
+
+	if err == nil {
+		var usage common.UsageResponse
+
+		if err := gossh.Unmarshal(reply, &usage); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(w, "Today (%s)\t%s in, %s out, quota %s\n", usage.Day,
+			common.FormatBytes(usage.DailyIn), common.FormatBytes(usage.DailyOut), formatQuota(usage.DailyQuota))
+		fmt.Fprintf(w, "Month (%s)\t%s in, %s out, quota %s\n", usage.Month,
+			common.FormatBytes(usage.MonthlyIn), common.FormatBytes(usage.MonthlyOut), formatQuota(usage.MonthlyQuota))
+	}
+
+	return w.Flush()
+}
+
+func (s *Server) hostsCommand(c *commandContext, args []string) error {
+	reply, err := s.request(c, common.HttpListHosts, nil)
+
+	if err != nil {
+		return err
+	}
+
+	var hosts []common.HostInfo
+
+	if err := json.Unmarshal(reply, &hosts); err != nil {
+		return err
+	}
+
+	if len(hosts) == 0 {
+		_, err := io.WriteString(c.out, "No hosts registered\n")
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "HOST\tROLE\tSTATUS\tCREATED\tLAST USE")
+
+	for _, host := range hosts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", host.Host, host.Role, onlineStatus(host.Online), formatTime(host.Created), formatTime(host.LastUse))
+	}
+
+	return w.Flush()
+}
+
+func (s *Server) registerCommand(c *commandContext, args []string) error {
+	if len(args) < 1 {
+		return ErrMissingArgument
+	}
+
+	reply, err := s.request(c, common.HttpRegisterHost, common.HostRegisterRequest{Host: args[0]})
+
+	if err != nil {
+		return err
+	}
+
+	var res common.HostRegisterSuccess
+
+	if err := gossh.Unmarshal(reply, &res); err != nil {
+		return err
+	}
+
+	var ext common.RegisterSuccessExtensions
+
+	if err := common.UnmarshalExtensions(res.Extensions, &ext); err != nil {
+		return err
+	}
+
+	if ext.Token != "" {
+		fmt.Fprintf(c.out, "Host %s requires verification. Create a TXT record named %s with the value %s, then run register again.\n", res.Host, ext.Record, ext.Token)
+		return nil
+	}
+
+	fmt.Fprintf(c.out, "Successfully registered host %s\n", res.Host)
+
+	if ext.Notice != "" {
+		fmt.Fprintln(c.out, ext.Notice)
+	}
+
+	return nil
+}
+
+func (s *Server) unregisterCommand(c *commandContext, args []string) error {
+	if len(args) < 1 {
+		return ErrMissingArgument
+	}
+
+	if _, err := s.request(c, common.HttpUnregisterHost, common.HostRegisterRequest{Host: args[0]}); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(c.out, "Successfully unregistered host %s\n", strings.ToLower(args[0]))
+
+	return nil
+}
+
+func (s *Server) tunnelsCommand(c *commandContext, args []string) error {
+	manager, err := s.tunnels()
+
+	if err != nil {
+		return err
+	}
+
+	key := c.key
+
+	if c.admin {
+		key = ""
+	}
+
+	tunnels := manager.Tunnels(key)
+
+	if len(tunnels) == 0 {
+		_, err := io.WriteString(c.out, "No tunnels connected\n")
+		return err
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+
+	header := "HOST\tCLIENT\tCONNECTED\tIN\tOUT\tHEALTH"
+
+	if c.admin {
+		header += "\tKEY"
+	}
+
+	fmt.Fprintln(w, header)
+
+	for _, tunnel := range tunnels {
+		health := "healthy"
+
+		if !tunnel.Healthy {
+			health = "unhealthy"
+		}
+
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s", tunnel.Host, tunnel.RemoteAddr, formatTime(tunnel.Connected),
+			common.FormatBytes(tunnel.BytesIn), common.FormatBytes(tunnel.BytesOut), health)
+
+		if c.admin {
+			fmt.Fprintf(w, "\t%s", fingerprint(tunnel.Key))
+		}
+
+		fmt.Fprintln(w)
+	}
+
+	return w.Flush()
+}
+
+func (s *Server) killCommand(c *commandContext, args []string) error {
+	if len(args) < 1 {
+		return ErrMissingArgument
+	}
+
+	manager, err := s.tunnels()
+
+	if err != nil {
+		return err
+	}
+
+	key := c.key
+
+	if c.admin {
+		key = ""
+	}
+
+	host := strings.ToLower(args[0])
+
+	closed := manager.CloseTunnels(host, key)
+
+	if closed == 0 {
+		return ErrNoTunnels
+	}
+
+	log.WithFields(log.Fields{
+		"host":    host,
+		"clients": closed,
+		"admin":   c.admin,
+	}).Info("Disconnected clients from session command")
+
+	fmt.Fprintf(c.out, "Disconnected %d client(s) forwarding %s\n", closed, host)
+
+	return nil
+}
+
+func (s *Server) statsCommand(c *commandContext, args []string) error {
+	manager, err := s.tunnels()
+
+	if err != nil {
+		return err
+	}
+
+	tunnels := manager.Tunnels("")
+
+	hosts := make(map[string]bool)
+	keys := make(map[string]bool)
+
+	var bytesIn, bytesOut uint64
+	var inFlight int64
+
+	for _, tunnel := range tunnels {
+		hosts[tunnel.Host] = true
+		keys[tunnel.Key] = true
+		bytesIn += tunnel.BytesIn
+		bytesOut += tunnel.BytesOut
+		inFlight += tunnel.InFlight
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintf(w, "Uptime\t%s\n", time.Since(s.started).Round(time.Second))
+	fmt.Fprintf(w, "Tunnels\t%d\n", len(tunnels))
+	fmt.Fprintf(w, "Hosts\t%d\n", len(hosts))
+	fmt.Fprintf(w, "Keys\t%d\n", len(keys))
+	fmt.Fprintf(w, "Requests in flight\t%d\n", inFlight)
+	fmt.Fprintf(w, "Traffic\t%s in, %s out\n", common.FormatBytes(bytesIn), common.FormatBytes(bytesOut))
+
+	return w.Flush()
+}
+
+// fingerprint returns the SHA256 fingerprint of a key in authorized keys format
+func fingerprint(key string) string {
+	pubKey, _, _, _, err := gossh.ParseAuthorizedKey([]byte(key))
+
+	if err != nil {
+		return key
+	}
+
+	return gossh.FingerprintSHA256(pubKey)
+}
+
+// onlineStatus formats whether a host is online
+func onlineStatus(online bool) string {
+	if online {
+		return "online"
+	}
+
+	return "offline"
+}
+
+// formatTime formats a time, where the zero time is unknown
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+
+	return t.UTC().Format("2006-01-02 15:04 MST")
+}
+
+// formatQuota formats a quota, where 0 means unlimited
+func formatQuota(n uint64) string {
+	if n == 0 {
+		return "unlimited"
+	}
+
+	return common.FormatBytes(n)
+}
@@ -3,6 +3,7 @@ package store
 import (
 	"encoding/json"
 	"github.com/boltdb/bolt"
+	"time"
 )
 
 type BoltStore struct {
@@ -18,8 +19,13 @@ func NewBoltStore(path string) (Store, error) {
 	}
 
 	err = db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte("hosts"))
-		return err
+		for _, bucket := range []string{"hosts", "usage"} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return err
+			}
+		}
+
+		return nil
 	})
 
 	if err != nil {
@@ -71,6 +77,32 @@ func (b *BoltStore) Get(key string) (*Host, error) {
 	return &host, nil
 }
 
+// List retrieves and deserializes all hosts in the hosts bucket
+func (b *BoltStore) List() ([]Host, error) {
+	hosts := make([]Host, 0)
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("hosts"))
+
+		return b.ForEach(func(k, v []byte) error {
+			var host Host
+
+			if err := json.Unmarshal(v, &host); err != nil {
+				return err
+			}
+
+			hosts = append(hosts, host)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return hosts, nil
+}
+
 // Add updates the hosts bucket and puts a json-serialized version of Host
 func (b *BoltStore) Add(host Host) error {
 	data, err := json.Marshal(host)
@@ -86,6 +118,66 @@ func (b *BoltStore) Add(host Host) error {
 	})
 }
 
+// Touch updates the last use time of a host, reading and writing it in the same transaction
+func (b *BoltStore) Touch(key string, lastUse time.Time) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("hosts"))
+
+		data := b.Get([]byte(key))
+
+		if data == nil {
+			return ErrNoHost
+		}
+
+		var host Host
+
+		if err := json.Unmarshal(data, &host); err != nil {
+			return err
+		}
+
+		host.LastUse = lastUse
+
+		data, err := json.Marshal(host)
+
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(key), data)
+	})
+}
+
+// Expire deletes a host which isn't pinned and hasn't been used since unusedSince, checking it in the same transaction
+func (b *BoltStore) Expire(key string, unusedSince time.Time) (bool, error) {
+	removed := false
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("hosts"))
+
+		data := b.Get([]byte(key))
+
+		if data == nil {
+			return nil
+		}
+
+		var host Host
+
+		if err := json.Unmarshal(data, &host); err != nil {
+			return err
+		}
+
+		if !host.expired(unusedSince) {
+			return nil
+		}
+
+		removed = true
+
+		return b.Delete([]byte(key))
+	})
+
+	return removed && err == nil, err
+}
+
 // Remove updates the hosts bucket and deletes the key
 func (b *BoltStore) Remove(key string) error {
 	return b.db.Update(func(tx *bolt.Tx) error {
@@ -94,3 +186,70 @@ func (b *BoltStore) Remove(key string) error {
 		return b.Delete([]byte(key))
 	})
 }
+
+// usageKey builds the usage bucket key for a key and period
+func usageKey(key, period string) []byte {
+	return []byte(period + "|" + key)
+}
+
+// AddUsage increments the usage for key during period and returns the new totals
+func (b *BoltStore) AddUsage(key, period string, bytesIn, bytesOut uint64) (*Usage, error) {
+	usage := Usage{
+		Key:    key,
+		Period: period,
+	}
+
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("usage"))
+
+		if data := b.Get(usageKey(key, period)); data != nil {
+			if err := json.Unmarshal(data, &usage); err != nil {
+				return err
+			}
+		}
+
+		usage.BytesIn += bytesIn
+		usage.BytesOut += bytesOut
+
+		data, err := json.Marshal(usage)
+
+		if err != nil {
+			return err
+		}
+
+		return b.Put(usageKey(key, period), data)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &usage, nil
+}
+
+// GetUsage retrieves the usage for key during period.
+// Periods without recorded usage return an empty Usage.
+func (b *BoltStore) GetUsage(key, period string) (*Usage, error) {
+	usage := Usage{
+		Key:    key,
+		Period: period,
+	}
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("usage"))
+
+		data := b.Get(usageKey(key, period))
+
+		if data == nil {
+			return nil
+		}
+
+		return json.Unmarshal(data, &usage)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &usage, nil
+}
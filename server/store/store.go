@@ -2,6 +2,7 @@ package store
 
 import (
 	"errors"
+	"strings"
 	"time"
 )
 
@@ -17,11 +18,148 @@ type Store interface {
 	Remove(key string) error
 }
 
+// Lister is an optional Store capability to list all stored hosts
+type Lister interface {
+	List() ([]Host, error)
+}
+
+// Toucher is an optional Store capability to update a host's last use time in a single transaction
+type Toucher interface {
+	Touch(key string, lastUse time.Time) error
+}
+
+// Expirer is an optional Store capability to remove an unused host in a single transaction
+type Expirer interface {
+	Expire(key string, unusedSince time.Time) (bool, error)
+}
+
+// UsageStore is an optional Store capability to persist bandwidth usage per key
+type UsageStore interface {
+	AddUsage(key, period string, bytesIn, bytesOut uint64) (*Usage, error)
+	GetUsage(key, period string) (*Usage, error)
+}
+
+// Lookup retrieves the host registration for host.
+// Exact registrations take precedence over a wildcard registration of the parent domain (*.example.com).
+func Lookup(s Store, host string) (*Host, error) {
+	hostModel, err := s.Get(host)
+
+	if err != ErrNoHost {
+		return hostModel, err
+	}
+
+	idx := strings.Index(host, ".")
+
+	if idx == -1 || strings.HasPrefix(host, "*.") {
+		return nil, ErrNoHost
+	}
+
+	return s.Get("*" + host[idx:])
+}
+
+// Touch updates the last use time of a stored host, leaving other fields unchanged.
+// Stores without Toucher support fall back to Get and Add, which may overwrite concurrent changes.
+func Touch(s Store, key string, lastUse time.Time) error {
+	if toucher, ok := s.(Toucher); ok {
+		return toucher.Touch(key, lastUse)
+	}
+
+	host, err := s.Get(key)
+
+	if err != nil {
+		return err
+	}
+
+	host.LastUse = lastUse
+
+	return s.Add(*host)
+}
+
+// Expire removes a stored host which isn't pinned and hasn't been used since unusedSince, returning if it was removed.
+// The host is checked when it's removed, so hosts used after being listed are kept.
+// Stores without Expirer support fall back to Get and Remove, which may remove a host used between the two.
+func Expire(s Store, key string, unusedSince time.Time) (bool, error) {
+	if expirer, ok := s.(Expirer); ok {
+		return expirer.Expire(key, unusedSince)
+	}
+
+	host, err := s.Get(key)
+
+	if err == ErrNoHost {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if !host.expired(unusedSince) {
+		return false, nil
+	}
+
+	return true, s.Remove(key)
+}
+
 // Host represents a claimed host
+// Owner is the primary owner, able to manage co-owners and transfer the host
+// Custom hosts are outside the server's domains, and were verified using DNS
 type Host struct {
-	Host    string    `json:"host"`
-	Owner   string    `json:"owner"`
-	IP      string    `json:"ip"`
-	Created time.Time `json:"created"`
-	LastUse time.Time `json:"lastUse"`
+	Host     string    `json:"host"`
+	Owner    string    `json:"owner"`
+	CoOwners []string  `json:"coOwners,omitempty"`
+	IP       string    `json:"ip"`
+	Created  time.Time `json:"created"`
+	LastUse  time.Time `json:"lastUse"`
+	Pinned   bool      `json:"pinned,omitempty"`
+	Custom   bool      `json:"custom,omitempty"`
+}
+
+// expired checks if the host isn't pinned and hasn't been used since unusedSince
+func (h *Host) expired(unusedSince time.Time) bool {
+	return !h.Pinned && h.LastUse.Before(unusedSince)
+}
+
+// IsOwner checks if key is the owner or a co-owner of the host
+func (h *Host) IsOwner(key string) bool {
+	if h.Owner == key {
+		return true
+	}
+
+	return h.IsCoOwner(key)
+}
+
+// IsCoOwner checks if key is a co-owner of the host
+func (h *Host) IsCoOwner(key string) bool {
+	for _, owner := range h.CoOwners {
+		if owner == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RemoveCoOwner removes key from the host's co-owners
+func (h *Host) RemoveCoOwner(key string) {
+	owners := make([]string, 0, len(h.CoOwners))
+
+	for _, owner := range h.CoOwners {
+		if owner != key {
+			owners = append(owners, owner)
+		}
+	}
+
+	h.CoOwners = owners
+}
+
+// Usage represents the bandwidth used by a key during a period
+// Period is a day (2006-01-02) or a month (2006-01)
+type Usage struct {
+	Key      string `json:"key"`
+	Period   string `json:"period"`
+	BytesIn  uint64 `json:"bytesIn"`
+	BytesOut uint64 `json:"bytesOut"`
+}
+
+// Total returns the sum of incoming and outgoing bytes
+func (u Usage) Total() uint64 {
+	return u.BytesIn + u.BytesOut
 }
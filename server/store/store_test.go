@@ -0,0 +1,112 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLookup(t *testing.T) {
+	s, err := NewBoltStore(filepath.Join(t.TempDir(), "gogrok.db"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []Host{
+		{Host: "*.example.com", Owner: "wildcard"},
+		{Host: "app.example.com", Owner: "exact"},
+		{Host: "*.dev.example.com", Owner: "nested"},
+	} {
+		if err := s.Add(host); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		host  string
+		owner string
+		err   error
+	}{
+		// Exact registrations take precedence over wildcards
+		{host: "app.example.com", owner: "exact"},
+		{host: "other.example.com", owner: "wildcard"},
+		{host: "*.example.com", owner: "wildcard"},
+		{host: "api.dev.example.com", owner: "nested"},
+		// Wildcards only cover a single label
+		{host: "a.b.example.com", err: ErrNoHost},
+		{host: "example.com", err: ErrNoHost},
+		{host: "localhost", err: ErrNoHost},
+		// Wildcard hosts don't fall back to a parent wildcard
+		{host: "*.other.example.com", err: ErrNoHost},
+	}
+
+	for _, test := range tests {
+		host, err := Lookup(s, test.host)
+
+		if err != test.err {
+			t.Errorf("Lookup(%q) returned error %v, expected %v", test.host, err, test.err)
+			continue
+		}
+
+		if test.err == nil && host.Owner != test.owner {
+			t.Errorf("Lookup(%q) returned owner %q, expected %q", test.host, host.Owner, test.owner)
+		}
+	}
+}
+
+// basicStore hides optional capabilities of a Store, to test the fallbacks
+type basicStore struct {
+	Store
+}
+
+func TestExpire(t *testing.T) {
+	now := time.Now()
+
+	for name, newStore := range map[string]func(s Store) Store{
+		"bolt":     func(s Store) Store { return s },
+		"fallback": func(s Store) Store { return basicStore{s} },
+	} {
+		bolt, err := NewBoltStore(filepath.Join(t.TempDir(), "gogrok.db"))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := newStore(bolt)
+
+		for _, host := range []Host{
+			{Host: "unused.example.com", LastUse: now.Add(-2 * time.Hour)},
+			{Host: "used.example.com", LastUse: now},
+			{Host: "pinned.example.com", LastUse: now.Add(-2 * time.Hour), Pinned: true},
+		} {
+			if err := s.Add(host); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := map[string]bool{
+			"unused.example.com":  true,
+			"used.example.com":    false,
+			"pinned.example.com":  false,
+			"missing.example.com": false,
+		}
+
+		for host, expected := range tests {
+			removed, err := Expire(s, host, now.Add(-time.Hour))
+
+			if err != nil {
+				t.Errorf("%s: Expire(%q) returned error: %v", name, host, err)
+				continue
+			}
+
+			if removed != expected {
+				t.Errorf("%s: Expire(%q) = %v, expected %v", name, host, removed, expected)
+			}
+
+			if removed && s.Has(host) {
+				t.Errorf("%s: expired host %q is still stored", name, host)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+	"gogrok.ccatss.dev/common"
+	"net/http"
+)
+
+// maxRequestIDLength limits the length of request ids passed on from trusted proxies
+const maxRequestIDLength = 128
+
+var (
+	tracer     = otel.Tracer("gogrok.ccatss.dev/server")
+	propagator = propagation.TraceContext{}
+
+	// requestIDKey is the span attribute containing the request id
+	requestIDKey = attribute.Key("gogrok.request_id")
+)
+
+// newRequestID generates a random request id
+func newRequestID() string {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// validRequestID checks that a request id passed on from a trusted proxy is safe to log and pass to clients
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' || c == ':') {
+			return false
+		}
+	}
+
+	return true
+}
+
+// startRequest assigns a request id and starts the request's span.
+// Request ids and trace context are continued from trusted proxies and other cluster nodes, and replaced otherwise.
+func (h *ForwardedHTTPHandler) startRequest(w http.ResponseWriter, r *http.Request) (*http.Request, trace.Span) {
+	trusted := r.Context().Value(clusterContextKey{}) != nil || h.isTrustedProxy(remoteIP(r))
+
+	requestID := r.Header.Get(common.RequestIDHeader)
+
+	if !trusted || !validRequestID(requestID) {
+		requestID = newRequestID()
+	}
+
+	r.Header.Set(common.RequestIDHeader, requestID)
+	w.Header().Set(common.RequestIDHeader, requestID)
+
+	ctx := r.Context()
+
+	if trusted {
+		ctx = propagator.Extract(ctx, propagation.HeaderCarrier(r.Header))
+	}
+
+	ctx, span := tracer.Start(ctx, "gogrok.request",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPMethodKey.String(r.Method),
+			semconv.HTTPHostKey.String(r.Host),
+			semconv.HTTPTargetKey.String(r.URL.RequestURI()),
+			semconv.HTTPClientIPKey.String(remoteIP(r)),
+			requestIDKey.String(requestID),
+		),
+	)
+
+	// Pass our trace context on to the client and backend
+	propagator.Inject(ctx, propagation.HeaderCarrier(r.Header))
+
+	return r.WithContext(ctx), span
+}
+
+// endSpan records err on span if set, and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// statusWriter records the status code written to a http.ResponseWriter
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush passes flushes on, for streamed responses from other cluster nodes
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap returns the underlying http.ResponseWriter
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"sort"
+	"time"
+)
+
+// Tunnel describes a forward of a host to a connected client
+// Key is the client's public key in authorized keys format, and Pool is the strategy of a pooled host.
+type Tunnel struct {
+	Host       string
+	Key        string
+	RemoteAddr string
+	Pool       string
+	Connected  time.Time
+	BytesIn    uint64
+	BytesOut   uint64
+	InFlight   int64
+	Healthy    bool
+}
+
+// Tunnels lists the current forwards, sorted by host.
+// When key is set, only the forwards of key are listed.
+func (h *ForwardedHTTPHandler) Tunnels(key string) []Tunnel {
+	h.RLock()
+	defer h.RUnlock()
+
+	tunnels := make([]Tunnel, 0)
+
+	for host, pool := range h.forwards {
+		for _, fw := range pool.forwards() {
+			fwKey := marshalKey(fw.Key)
+
+			if key != "" && fwKey != key {
+				continue
+			}
+
+			tunnels = append(tunnels, Tunnel{
+				Host:       host,
+				Key:        fwKey,
+				RemoteAddr: fw.Conn.RemoteAddr().String(),
+				Pool:       pool.strategy,
+				Connected:  fw.connected,
+				BytesIn:    fw.BytesIn(),
+				BytesOut:   fw.BytesOut(),
+				InFlight:   fw.InFlight(),
+				Healthy:    fw.Healthy(),
+			})
+		}
+	}
+
+	sort.Slice(tunnels, func(i, j int) bool {
+		if tunnels[i].Host != tunnels[j].Host {
+			return tunnels[i].Host < tunnels[j].Host
+		}
+
+		return tunnels[i].Connected.Before(tunnels[j].Connected)
+	})
+
+	return tunnels
+}
+
+// CloseTunnels disconnects the clients forwarding host, returning the number of clients disconnected.
+// When key is set, only the clients of key are disconnected.
+func (h *ForwardedHTTPHandler) CloseTunnels(host, key string) int {
+	h.RLock()
+	pool, exists := h.forwards[host]
+	h.RUnlock()
+
+	if !exists {
+		return 0
+	}
+
+	closed := 0
+
+	for _, fw := range pool.forwards() {
+		if key != "" && marshalKey(fw.Key) != key {
+			continue
+		}
+
+		// The forward is removed once the connection's context is done
+		fw.Conn.Close()
+		closed++
+	}
+
+	return closed
+}
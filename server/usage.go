@@ -0,0 +1,309 @@
+package server
+
+import (
+	"context"
+	"errors"
+	log "github.com/sirupsen/logrus"
+	"gogrok.ccatss.dev/server/store"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Quota represents bandwidth limits for a key, in bytes.
+// Zero values are unlimited.
+type Quota struct {
+	Daily   uint64
+	Monthly uint64
+}
+
+// QuotaProvider returns the quota for a marshalled public key
+type QuotaProvider func(key string) Quota
+
+// Unlimited is a QuotaProvider which doesn't limit any key
+func Unlimited(key string) Quota {
+	return Quota{}
+}
+
+// StaticQuotas returns a QuotaProvider using per-key quotas, falling back to def
+func StaticQuotas(quotas map[string]Quota, def Quota) QuotaProvider {
+	return func(key string) Quota {
+		if quota, ok := quotas[key]; ok {
+			return quota
+		}
+
+		return def
+	}
+}
+
+// dailyPeriod returns the usage period for the day of t
+func dailyPeriod(t time.Time) string {
+	return t.UTC().Format("2006-01-02")
+}
+
+// monthlyPeriod returns the usage period for the month of t
+func monthlyPeriod(t time.Time) string {
+	return t.UTC().Format("2006-01")
+}
+
+// DefaultUsageFlushInterval is how often bandwidth usage is persisted to the store
+const DefaultUsageFlushInterval = 10 * time.Second
+
+var (
+	ErrQuotaExceeded = errors.New("bandwidth quota exceeded")
+)
+
+// usageMeter keeps running bandwidth totals per key in memory.
+// When a store.UsageStore is available, totals are loaded from it and usage is persisted by Flush.
+// The store is only accessed without holding the lock, as it's checked while passing each chunk of a transfer.
+type usageMeter struct {
+	store   store.UsageStore
+	usage   map[string]*store.Usage
+	pending map[string]*store.Usage
+	sync.Mutex
+
+	// flushLock prevents concurrent flushes from persisting usage out of order
+	flushLock sync.Mutex
+}
+
+func newUsageMeter(s store.Store) *usageMeter {
+	m := &usageMeter{
+		usage:   make(map[string]*store.Usage),
+		pending: make(map[string]*store.Usage),
+	}
+
+	if usageStore, ok := s.(store.UsageStore); ok {
+		m.store = usageStore
+	}
+
+	return m
+}
+
+// add records bytesIn and bytesOut against the current day and month of key
+func (m *usageMeter) add(key string, bytesIn, bytesOut uint64) {
+	now := time.Now()
+
+	periods := []string{dailyPeriod(now), monthlyPeriod(now)}
+	totals := make([]*store.Usage, len(periods))
+
+	for i, period := range periods {
+		totals[i] = m.load(key, period, now)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	for i, period := range periods {
+		usage := totals[i]
+
+		usage.BytesIn += bytesIn
+		usage.BytesOut += bytesOut
+
+		if m.store == nil {
+			continue
+		}
+
+		pending, exists := m.pending[period+"|"+key]
+
+		if !exists {
+			pending = &store.Usage{Key: key, Period: period}
+			m.pending[period+"|"+key] = pending
+		}
+
+		pending.BytesIn += bytesIn
+		pending.BytesOut += bytesOut
+	}
+}
+
+// load returns the running total of key during period, loading it from the store on first use.
+// The returned total must only be accessed while holding the lock.
+func (m *usageMeter) load(key, period string, now time.Time) *store.Usage {
+	m.Lock()
+	usage, exists := m.usage[period+"|"+key]
+	m.Unlock()
+
+	if exists {
+		return usage
+	}
+
+	usage = &store.Usage{Key: key, Period: period}
+
+	if m.store != nil {
+		persisted, err := m.store.GetUsage(key, period)
+
+		if err != nil {
+			log.WithError(err).Warning("Unable to load bandwidth usage")
+		} else {
+			usage = persisted
+		}
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	// Another transfer may have loaded the total while the store was read
+	if existing, exists := m.usage[period+"|"+key]; exists {
+		return existing
+	}
+
+	m.prune(now)
+
+	m.usage[period+"|"+key] = usage
+
+	return usage
+}
+
+// prune removes in-memory usage from previous periods, which are kept in pending until flushed.
+// The caller must hold the lock.
+func (m *usageMeter) prune(now time.Time) {
+	day, month := dailyPeriod(now), monthlyPeriod(now)
+
+	for k, usage := range m.usage {
+		if usage.Period != day && usage.Period != month {
+			delete(m.usage, k)
+		}
+	}
+}
+
+// get returns the usage of key during period
+func (m *usageMeter) get(key, period string) store.Usage {
+	usage := m.load(key, period, time.Now())
+
+	m.Lock()
+	defer m.Unlock()
+
+	return *usage
+}
+
+// exceeds checks if key has used up its daily or monthly quota
+func (m *usageMeter) exceeds(key string, quota Quota) bool {
+	now := time.Now()
+
+	if quota.Daily > 0 && m.get(key, dailyPeriod(now)).Total() >= quota.Daily {
+		return true
+	}
+
+	if quota.Monthly > 0 && m.get(key, monthlyPeriod(now)).Total() >= quota.Monthly {
+		return true
+	}
+
+	return false
+}
+
+// flush persists the usage recorded since the last flush.
+// Usage which fails to persist is kept for the next flush.
+func (m *usageMeter) flush() {
+	if m.store == nil {
+		return
+	}
+
+	m.flushLock.Lock()
+	defer m.flushLock.Unlock()
+
+	m.Lock()
+	pending := m.pending
+	m.pending = make(map[string]*store.Usage)
+	m.Unlock()
+
+	for k, usage := range pending {
+		if _, err := m.store.AddUsage(usage.Key, usage.Period, usage.BytesIn, usage.BytesOut); err != nil {
+			log.WithError(err).Warning("Unable to persist bandwidth usage")
+
+			m.Lock()
+			if retry, exists := m.pending[k]; exists {
+				retry.BytesIn += usage.BytesIn
+				retry.BytesOut += usage.BytesOut
+			} else {
+				m.pending[k] = usage
+			}
+			m.Unlock()
+		}
+	}
+}
+
+// meter returns a func recording bytes passed through a channel of fw against fw and key.
+// It fails once key has used up quota, so transfers stop instead of exceeding it.
+func (h *ForwardedHTTPHandler) meter(fw *Forward, key string, quota Quota) func(bytesIn, bytesOut uint64) error {
+	return func(bytesIn, bytesOut uint64) error {
+		atomic.AddUint64(&fw.bytesIn, bytesIn)
+		atomic.AddUint64(&fw.bytesOut, bytesOut)
+
+		h.usage.add(key, bytesIn, bytesOut)
+
+		if h.usage.exceeds(key, quota) {
+			return ErrQuotaExceeded
+		}
+
+		return nil
+	}
+}
+
+// FlushUsage persists bandwidth usage to the store. It should be called before shutting down.
+func (h *ForwardedHTTPHandler) FlushUsage() {
+	h.usage.flush()
+}
+
+// RunUsageFlusher periodically persists bandwidth usage until ctx is done
+func (h *ForwardedHTTPHandler) RunUsageFlusher(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			h.usage.flush()
+			return
+		case <-ticker.C:
+			h.usage.flush()
+		}
+	}
+}
+
+// meteredWriter passes the bytes written to the underlying writer to meter.
+// Once meter fails, its error is returned by every later write.
+type meteredWriter struct {
+	w     io.Writer
+	meter func(bytesIn, bytesOut uint64) error
+	err   error
+}
+
+func (m *meteredWriter) Write(p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+
+	n, err := m.w.Write(p)
+
+	if n > 0 {
+		if m.err = m.meter(uint64(n), 0); m.err != nil && err == nil {
+			err = m.err
+		}
+	}
+
+	return n, err
+}
+
+// meteredReader passes the bytes read from the underlying reader to meter.
+// Once meter fails, its error is returned by every later read, as bufio.Reader may read again after an error.
+type meteredReader struct {
+	r     io.Reader
+	meter func(bytesIn, bytesOut uint64) error
+	err   error
+}
+
+func (m *meteredReader) Read(p []byte) (int, error) {
+	if m.err != nil {
+		return 0, m.err
+	}
+
+	n, err := m.r.Read(p)
+
+	if n > 0 {
+		if m.err = m.meter(0, uint64(n)); m.err != nil && err == nil {
+			err = m.err
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"gogrok.ccatss.dev/server/store"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	// ChallengeRecordPrefix is prepended to a domain to build the TXT record name used for verification
+	ChallengeRecordPrefix = "_gogrok-challenge."
+
+	challengeTimeout = 10 * time.Second
+)
+
+// TXTResolver looks up the TXT records of a name
+type TXTResolver func(ctx context.Context, name string) ([]string, error)
+
+// NewTXTResolver creates a TXTResolver using the dns server at address (host:port).
+// An empty address uses the system resolver.
+func NewTXTResolver(address string) TXTResolver {
+	if address == "" {
+		return net.DefaultResolver.LookupTXT
+	}
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+
+	return resolver.LookupTXT
+}
+
+// WithDomainVerification allows registration of hosts outside the validator's domains,
+// once ownership is proven with a DNS TXT record looked up using resolver.
+func WithDomainVerification(resolver TXTResolver) HandlerOption {
+	return func(h *ForwardedHTTPHandler) {
+		h.resolver = resolver
+	}
+}
+
+// ChallengeRecord returns the TXT record name used to verify host.
+// Wildcard hosts are verified using their parent domain.
+func ChallengeRecord(host string) string {
+	return ChallengeRecordPrefix + strings.TrimPrefix(host, "*.")
+}
+
+// ChallengeToken returns the TXT record value which proves that key may register host
+func ChallengeToken(host, key string) string {
+	sum := sha256.Sum256([]byte(strings.TrimPrefix(host, "*.") + "\n" + key))
+
+	return "gogrok-verification=" + hex.EncodeToString(sum[:16])
+}
+
+// verifyDomain checks if the challenge record for host contains the token for key
+func (h *ForwardedHTTPHandler) verifyDomain(host, key string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), challengeTimeout)
+	defer cancel()
+
+	records, err := h.resolver(ctx, ChallengeRecord(host))
+
+	if err != nil {
+		return false
+	}
+
+	token := ChallengeToken(host, key)
+
+	for _, record := range records {
+		if strings.TrimSpace(record) == token {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isCustomHost checks if host is covered by a verified custom domain registration
+func (h *ForwardedHTTPHandler) isCustomHost(host string) bool {
+	if h.store == nil {
+		return false
+	}
+
+	hostModel, err := store.Lookup(h.store, host)
+
+	return err == nil && hostModel.Custom
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// stubResolver resolves TXT records from a map, failing for unknown names
+func stubResolver(records map[string][]string) TXTResolver {
+	return func(ctx context.Context, name string) ([]string, error) {
+		if values, exists := records[name]; exists {
+			return values, nil
+		}
+
+		return nil, errors.New("no such host")
+	}
+}
+
+func TestVerifyDomain(t *testing.T) {
+	const key = "ssh-ed25519 AAAA"
+
+	h := &ForwardedHTTPHandler{
+		resolver: stubResolver(map[string][]string{
+			"_gogrok-challenge.example.com":  {"v=spf1 -all", " " + ChallengeToken("example.com", key) + " "},
+			"_gogrok-challenge.other.com":    {ChallengeToken("other.com", "ssh-ed25519 BBBB")},
+			"_gogrok-challenge.wildcard.com": {ChallengeToken("wildcard.com", key)},
+		}),
+	}
+
+	tests := []struct {
+		host     string
+		verified bool
+	}{
+		{host: "example.com", verified: true},
+		// Tokens are specific to the key
+		{host: "other.com", verified: false},
+		// Wildcards are verified using their parent domain
+		{host: "*.wildcard.com", verified: true},
+		// Tokens are specific to the host
+		{host: "app.example.com", verified: false},
+		{host: "missing.com", verified: false},
+	}
+
+	for _, test := range tests {
+		if verified := h.verifyDomain(test.host, key); verified != test.verified {
+			t.Errorf("verifyDomain(%q) = %v, expected %v", test.host, verified, test.verified)
+		}
+	}
+}
+
+func TestChallengeRecord(t *testing.T) {
+	tests := map[string]string{
+		"example.com":       "_gogrok-challenge.example.com",
+		"*.example.com":     "_gogrok-challenge.example.com",
+		"app.example.com":   "_gogrok-challenge.app.example.com",
+		"*.app.example.com": "_gogrok-challenge.app.example.com",
+	}
+
+	for host, expected := range tests {
+		if record := ChallengeRecord(host); record != expected {
+			t.Errorf("ChallengeRecord(%q) = %q, expected %q", host, record, expected)
+		}
+	}
+
+	if ChallengeToken("*.example.com", "key") != ChallengeToken("example.com", "key") {
+		t.Error("wildcard token differs from its parent domain's token")
+	}
+}